@@ -87,9 +87,17 @@ func Build(ctx context.Context, c client.Client) (_ *client.Result, err error) {
 		},
 	}
 
+	// `HandleSubrequest()` only knows the upstream outline, so the full one
+	// (with packages) is kept aside and its result replaces the upstream one.
+	var fullOutline *dockerfile2llb.Outline
 	if res, ok, err := bc.HandleSubrequest(ctx, dockerui.RequestHandler{
 		Outline: func(ctx context.Context) (*outline.Outline, error) {
-			return dockerfile2llb.Dockerfile2Outline(ctx, src.Data, convertOpt)
+			o, err := dockerfile2llb.Dockerfile2Outline(ctx, src.Data, convertOpt)
+			if err != nil {
+				return nil, err
+			}
+			fullOutline = o
+			return &o.Outline, nil
 		},
 		ListTargets: func(ctx context.Context) (*targets.List, error) {
 			return dockerfile2llb.ListTargets(ctx, src.Data)
@@ -102,6 +110,8 @@ func Build(ctx context.Context, c client.Client) (_ *client.Result, err error) {
 		},
 	}); err != nil {
 		return nil, err
+	} else if fullOutline != nil {
+		return fullOutline.ToResult()
 	} else if ok {
 		return res, nil
 	}
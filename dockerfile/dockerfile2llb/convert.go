@@ -27,7 +27,6 @@ import (
 	"github.com/moby/buildkit/frontend/gateway/client"
 	"github.com/moby/buildkit/frontend/subrequests/convertllb"
 	"github.com/moby/buildkit/frontend/subrequests/lint"
-	"github.com/moby/buildkit/frontend/subrequests/outline"
 	"github.com/moby/buildkit/frontend/subrequests/targets"
 	"github.com/moby/buildkit/solver/pb"
 	"github.com/moby/buildkit/util/apicaps"
@@ -47,11 +46,24 @@ const (
 
 	sbomScanContext = "BUILDKIT_SBOM_SCAN_CONTEXT"
 	sbomScanStage   = "BUILDKIT_SBOM_SCAN_STAGE"
+
+	aptAutoRewrite      = "BUILDKIT_APT_AUTOREWRITE"
+	aptRequireDigest    = "BUILDKIT_APT_REQUIRE_DIGEST"
+	aptMaxDownloadSize  = "BUILDKIT_APT_MAX_DOWNLOAD_SIZE"
+	aptPolicy           = "BUILDKIT_APT_POLICY"
+	aptAdvisorySeverity = "BUILDKIT_APT_ADVISORY_SEVERITY"
+	aptAdvisoryIgnore   = "BUILDKIT_APT_ADVISORY_IGNORE"
 )
 
 var nonEnvArgs = map[string]struct{}{
-	sbomScanContext: {},
-	sbomScanStage:   {},
+	sbomScanContext:     {},
+	sbomScanStage:       {},
+	aptAutoRewrite:      {},
+	aptRequireDigest:    {},
+	aptMaxDownloadSize:  {},
+	aptPolicy:           {},
+	aptAdvisorySeverity: {},
+	aptAdvisoryIgnore:   {},
 }
 
 type ConvertOpt struct {
@@ -64,6 +76,10 @@ type ConvertOpt struct {
 	LLBCaps        *apicaps.CapSet
 	Warn           linter.LintWarnFunc
 	AllStages      bool
+
+	// skipPackages records `ADD --apt` commands without running apt, for
+	// subrequests that only inspect the Dockerfile.
+	skipPackages bool
 }
 
 type SBOMTargets struct {
@@ -100,12 +116,22 @@ func Dockerfile2LLB(ctx context.Context, dt []byte, opt ConvertOpt) (*Result, er
 	if ds.scanContext {
 		res.SBOM.Extras["context"] = ds.opt.buildContext
 	}
+	if st, ok, err := packageSBOM(ds); err != nil {
+		return nil, err
+	} else if ok {
+		res.SBOM.Extras[packageSBOMName] = st
+	}
 	if ds.ignoreCache {
 		res.IsIgnoreCache = true
 	}
 	for dsi := range allReachableStages(ds) {
 		if ds != dsi && dsi.scanStage {
 			res.SBOM.Extras[dsi.stageName] = dsi.state
+			if st, ok, err := packageSBOM(dsi); err != nil {
+				return nil, err
+			} else if ok {
+				res.SBOM.Extras[packageSBOMName+"-"+dsi.stageName] = st
+			}
 			if dsi.ignoreCache {
 				res.IsIgnoreCache = true
 			}
@@ -115,7 +141,9 @@ func Dockerfile2LLB(ctx context.Context, dt []byte, opt ConvertOpt) (*Result, er
 	return res, nil
 }
 
-func Dockerfile2Outline(ctx context.Context, dt []byte, opt ConvertOpt) (*outline.Outline, error) {
+func Dockerfile2Outline(ctx context.Context, dt []byte, opt ConvertOpt) (*Outline, error) {
+	// Packages are listed in the outline, but there's no need to resolve them.
+	opt.skipPackages = true
 	ds, err := toDispatchState(ctx, dt, opt)
 	if err != nil {
 		return nil, err
@@ -221,6 +249,7 @@ type dispatchContext struct {
 	allDispatchStates *dispatchStates
 	proxyEnv          *llb.ProxyEnv
 	namedContext      func(string, dockerui.ContextOpt) (*dockerui.NamedContext, error)
+	packageChecks     *packageChecks
 }
 
 func namedContextFunc(opt ConvertOpt) func(string, dockerui.ContextOpt) (*dockerui.NamedContext, error) {
@@ -284,6 +313,7 @@ func toDispatchState(ctx context.Context, dt []byte, opt ConvertOpt) (*dispatchS
 	}
 	validateStageNames(stages, lint)
 	validateCommandCasing(stages, lint)
+	validatePackageManagerUsage(stages, lint)
 
 	platformOpt := buildPlatformOpt(&opt)
 	targetName := opt.Target
@@ -329,6 +359,7 @@ func toDispatchState(ctx context.Context, dt []byte, opt ConvertOpt) (*dispatchS
 		allDispatchStates: newDispatchStates(),
 		proxyEnv:          proxyEnvFromBuildArgs(opt.BuildArgs),
 		namedContext:      namedContextFunc(opt),
+		packageChecks:     &packageChecks{},
 	}
 
 	if err := dctx.buildDispatchStates(stages); err != nil {
@@ -486,19 +517,16 @@ func (dctx *dispatchContext) buildDispatchStates(stages []instructions.Stage) er
 			ds.outline.usedArgs[k] = struct{}{}
 		}
 
+		if v, ok := dctx.opt.BuildArgs[aptAutoRewrite]; ok && isEnabledForStage(ds.stageName, v) {
+			ds.stage.Commands = rewriteAptRuns(ds.stage.Commands, lint)
+		}
+
 		total := 0
 		if ds.stage.BaseName != emptyImageName && ds.base == nil {
 			total = 1
 		}
 		for _, cmd := range ds.stage.Commands {
-			switch cmd.(type) {
-			case *instructions.AddCommand, *instructions.CopyCommand, *instructions.RunCommand:
-				total++
-			case *instructions.WorkdirCommand:
-				total++
-			case *instructions.PackageCommand:
-				total += PackageStepCount
-			}
+			total += commandStepCount(cmd)
 		}
 		ds.cmdTotal = total
 		if dctx.opt.Client != nil {
@@ -523,7 +551,7 @@ func (dctx *dispatchContext) buildStageDependencyGraph() error {
 	for _, d := range dctx.allDispatchStates.states {
 		d.commands = make([]command, len(d.stage.Commands))
 		for i, cmd := range d.stage.Commands {
-			newCmd, err := toCommand(cmd, dctx.allDispatchStates, dctx.shlex)
+			newCmd, err := toCommand(cmd, dctx.allDispatchStates, dctx.shlex, dctx.globalArgs)
 			if err != nil {
 				return err
 			}
@@ -825,6 +853,7 @@ func (dctx *dispatchContext) dispatchStages(ctx context.Context, allReachable ma
 		}
 
 		d.state = d.state.Network(dctx.opt.NetworkMode)
+		d.linkBase = d.state
 
 		dopt := dispatchOpt{
 			allDispatchStates:   dctx.allDispatchStates,
@@ -850,6 +879,8 @@ func (dctx *dispatchContext) dispatchStages(ctx context.Context, allReachable ma
 			gatewayClient:       dctx.opt.MetaResolver,
 			context:             ctx,
 			rawBuildContext:     buildContext,
+			skipPackages:        dctx.opt.skipPackages,
+			packageChecks:       dctx.packageChecks,
 		}
 
 		for _, cmd := range d.commands {
@@ -946,7 +977,7 @@ func (dctx *dispatchContext) finalizeResultImage(ctx context.Context, target *di
 	return nil
 }
 
-func toCommand(ic instructions.Command, allDispatchStates *dispatchStates, shlex *shell.Lex) (command, error) {
+func toCommand(ic instructions.Command, allDispatchStates *dispatchStates, shlex *shell.Lex, globalArgs shell.EnvGetter) (command, error) {
 	cmd := command{Command: ic}
 	if c, ok := ic.(*instructions.CopyCommand); ok {
 		if c.From != "" {
@@ -983,7 +1014,8 @@ func toCommand(ic instructions.Command, allDispatchStates *dispatchStates, shlex
 		return cmd, nil
 	}
 
-	return cmd, nil
+	_, err := detectPackageSources(&cmd, allDispatchStates, shlex, globalArgs)
+	return cmd, err
 }
 
 type dispatchOpt struct {
@@ -1010,6 +1042,8 @@ type dispatchOpt struct {
 	gatewayClient       client.Client
 	context             context.Context
 	rawBuildContext     *mutableOutput
+	skipPackages        bool
+	packageChecks       *packageChecks
 }
 
 func getEnv(state llb.State) shell.EnvGetter {
@@ -1079,6 +1113,7 @@ func dispatch(d *dispatchState, cmd command, opt dispatchOpt) error {
 		err = dispatchEnv(d, c, opt.lint)
 	case *instructions.RunCommand:
 		err = dispatchRun(d, c, opt.proxyEnv, cmd.sources, opt)
+		d.packagesChangedAt = c.Location()
 	case *instructions.WorkdirCommand:
 		err = dispatchWorkdir(d, c, true, &opt)
 	case *instructions.AddCommand:
@@ -1169,7 +1204,7 @@ func dispatch(d *dispatchState, cmd command, opt dispatchOpt) error {
 			}
 		}
 	case *instructions.PackageCommand:
-		err = NewPackageInvocation(d, c, opt).Dispatch()
+		err = NewPackageInvocation(d, c, cmd.sources, opt).Dispatch()
 	default:
 	}
 	return err
@@ -1208,6 +1243,20 @@ type dispatchState struct {
 	// workdirSet is set to true if a workdir has been set
 	// within the current dockerfile.
 	workdirSet bool
+	// packages records the packages installed by `ADD --apt` in this stage
+	// and its bases.
+	packages []packageRecord
+	// packageGroups maps each `ADD --apt --group` name to the packages
+	// installed as its members, in this stage and its bases.
+	packageGroups map[string][]string
+	// linkBase is the state the stage started from, before any of its
+	// commands. `ADD --apt --link` computes package layers against it.
+	linkBase llb.State
+	// packagesChangedAt is the location of the last command in the stage that
+	// may have changed the installed packages. `ADD --apt --link` installs
+	// after it as a regular layer, since a linked layer would replace the
+	// package database it left behind.
+	packagesChangedAt []parser.Range
 
 	entrypoint  instructionTracker
 	cmd         instructionTracker
@@ -1237,6 +1286,8 @@ func (ds *dispatchState) init() {
 	ds.paths = ds.base.paths
 	ds.workdirSet = ds.base.workdirSet
 	ds.buildArgs = append(ds.buildArgs, ds.base.buildArgs...)
+	ds.packages = slices.Clone(ds.base.packages)
+	ds.packageGroups = maps.Clone(ds.base.packageGroups)
 }
 
 type dispatchStates struct {
@@ -1314,7 +1365,7 @@ func initOnBuildTriggers(d *dispatchState, triggers []string, allDispatchStates
 		if err != nil {
 			return false, err
 		}
-		cmd, err := toCommand(ic, allDispatchStates, shlex)
+		cmd, err := toCommand(ic, allDispatchStates, shlex, shell.EnvsFromSlice(nil))
 		if err != nil {
 			return false, err
 		}
@@ -1335,11 +1386,30 @@ func initOnBuildTriggers(d *dispatchState, triggers []string, allDispatchStates
 		}
 	}
 	d.commands = append(commands, d.commands...)
-	d.cmdTotal += len(commands)
+	for _, cmd := range commands {
+		d.cmdTotal += commandStepCount(cmd.Command)
+	}
 
 	return hasNewDeps, nil
 }
 
+// commandStepCount returns the number of numbered build steps a command is
+// dispatched as.
+func commandStepCount(cmd instructions.Command) int {
+	switch c := cmd.(type) {
+	case *instructions.AddCommand, *instructions.CopyCommand, *instructions.RunCommand:
+		return 1
+	case *instructions.WorkdirCommand:
+		return 1
+	case *instructions.PackageCommand:
+		if c.Remove != "" {
+			return 1
+		}
+		return PackageStepCount
+	}
+	return 0
+}
+
 func dispatchEnv(d *dispatchState, c *instructions.EnvCommand, lint *linter.Linter) error {
 	commitMessage := bytes.NewBufferString("ENV")
 	for _, e := range c.Env {
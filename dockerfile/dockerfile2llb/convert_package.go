@@ -2,14 +2,26 @@ package dockerfile2llb
 
 import (
 	"fmt"
+	"maps"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/btidor/syntax/dockerfile/instructions"
+	"github.com/btidor/syntax/dockerfile/linter"
+	"github.com/btidor/syntax/dockerfile/shell"
 	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
 	"github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/moby/buildkit/identity"
+	"github.com/moby/buildkit/solver/pb"
+	"github.com/moby/buildkit/util/suggest"
 	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 )
@@ -19,7 +31,6 @@ const PackageStepCount = 3
 var aptions = strings.Join([]string{
 	// Override the important apt options, since we don't know what
 	// configuration the container ships with.
-	"--option Acquire::ForceHash=sha256",
 	"--option Acquire::GzipIndexes=false",
 	"--option Dir::Cache=/btidor.syntax/cache",
 	"--option Dir::Cache::archives=archives/",
@@ -27,66 +38,512 @@ var aptions = strings.Join([]string{
 	"--yes", "--quiet",
 }, " ")
 
-var aptRegex = regexp.MustCompile(`^'([^']*)'\s+([^ ]+)\s+([0-9]+)(\s+SHA256:([0-9a-fA-F]+))?`)
+// packageDescriptionKey labels the LLB sources that fetch packages.
+const packageDescriptionKey = "btidor.syntax.apt.package"
+
+// mirrorPath is where the `--mirror` repository tree is mounted. The system's
+// configured sources are rewritten to point here.
+const mirrorPath = "/btidor.syntax/mirror"
+
+var mirrorSources = strings.Join([]string{
+	"mkdir -p /btidor.syntax/sources.list.d",
+	`for f in /etc/apt/sources.list /etc/apt/sources.list.d/*; do ` +
+		`if [ -f "$f" ]; then sed -E ` +
+		`-e 's#^([[:space:]]*deb(-src)?([[:space:]]+\[[^]]*\])?)[[:space:]]+[^[:space:]]+#\1 file:` + mirrorPath + `#' ` +
+		`-e 's#^([[:space:]]*URIs:).*#\1 file:` + mirrorPath + `#' ` +
+		`"$f" > "/btidor.syntax/sources.list.d/${f##*/}"; fi; done`,
+}, " && ")
+
+// copySources copies the configured sources to where mirrorSources would
+// have written them, so that they can be changed without touching the image.
+var copySources = strings.Join([]string{
+	"mkdir -p /btidor.syntax/sources.list.d",
+	`for f in /etc/apt/sources.list /etc/apt/sources.list.d/*; do ` +
+		`if [ -f "$f" ]; then cp "$f" "/btidor.syntax/sources.list.d/${f##*/}"; fi; done`,
+}, " && ")
+
+// debSrcSources adds a deb-src entry for every deb entry in the copied
+// sources, for `--build-dep`.
+var debSrcSources = `for f in /btidor.syntax/sources.list.d/*; do if [ -f "$f" ]; then sed -i -E ` +
+	`-e '/^[[:space:]]*deb[[:space:]]/{p;s/^([[:space:]]*)deb/\1deb-src/}' ` +
+	`-e '/^[[:space:]]*Types:/{/deb-src/!s/$/ deb-src/}' "$f"; fi; done`
+
+// debPath is where .deb files named by `ADD --apt` are stored in the
+// temporary image, each in a directory of its own.
+const debPath = "/btidor.syntax/debs"
+
+// packageFilesPath is where the control fields of the .deb files named by
+// `ADD --apt` are stored in the temporary image.
+const packageFilesPath = "/btidor.syntax/debs.info"
+
+// packageFilesScript records the control fields and digest of each .deb file,
+// since a file's name needn't match the package it contains.
+var packageFilesScript = "for f in " + debPath + "/*/*.deb; do " +
+	`[ -e "$f" ] || continue; echo "Filename: $f" && ` +
+	`echo "SHA256: $(sha256sum "$f" | cut -d ' ' -f 1)" && ` +
+	`dpkg-deb -f "$f" Package Version Architecture Source && echo; ` +
+	"done > " + packageFilesPath
+
+// buildDepPath is where debian/control files for `--build-dep` are stored in
+// the temporary image, each in a source tree of its own.
+const buildDepPath = "/btidor.syntax/build-dep"
+
+// copiedSourcesOptions make apt read sources from the copies created by
+// mirrorSources or copySources.
+const copiedSourcesOptions = " --option Dir::Etc::SourceList=/dev/null" +
+	" --option Dir::Etc::SourceParts=/btidor.syntax/sources.list.d/"
+
+// packageIndexScript turns a directory of .deb files into a flat repository.
+// Epochs are dropped from the filenames, as they would be in a pool.
+var packageIndexScript = strings.Join([]string{
+	`for f in *%3a*.deb; do if [ -e "$f" ]; then ` +
+		`mv "$f" "$(echo "$f" | sed 's/_[0-9]*%3a/_/')"; fi; done`,
+	`for f in *.deb; do if [ -e "$f" ]; then dpkg-deb -f "$f" && ` +
+		`printf 'Filename: ./%s\nSize: %s\nSHA256: %s\n\n' "$f" "$(wc -c < "$f")" ` +
+		`"$(sha256sum "$f" | cut -d ' ' -f 1)"; fi; done > Packages`,
+	`printf 'SHA256:\n %s %s Packages\n' "$(sha256sum Packages | cut -d ' ' -f 1)" ` +
+		`"$(wc -c < Packages)" > Release`,
+}, " && ")
+
+// debconfPath is where `--debconf` selections are stored in the temporary
+// image.
+const debconfPath = "/btidor.syntax/debconf"
+
+// listsDateLabel records the date of the package lists kept by
+// `--keep-lists`.
+const listsDateLabel = "btidor.syntax.apt.lists-date"
+
+var keepListsScript = "mkdir -p /var/lib/apt/lists && " +
+	"find /btidor.syntax/state/lists -maxdepth 1 -type f ! -name lock " +
+	"-exec cp -t /var/lib/apt/lists {} +"
+
+// slimFilters are the dpkg path filters for each `--slim` category. Copyright
+// files are kept for license compliance.
+var slimFilters = map[string]struct{ exclude, include []string }{
+	"doc": {
+		exclude: []string{"/usr/share/doc/*", "/usr/share/doc-base/*", "/usr/share/info/*"},
+		include: []string{"/usr/share/doc/*/copyright"},
+	},
+	"man": {
+		exclude: []string{"/usr/share/man/*"},
+	},
+	"locale": {
+		exclude: []string{"/usr/share/locale/*"},
+		include: []string{"/usr/share/locale/locale.alias", "/usr/share/locale/en*"},
+	},
+}
+
+// disableServicesScript keeps maintainer scripts from starting services: a
+// policy-rc.d that denies everything stops invoke-rc.d, and systemctl and
+// start-stop-daemon are replaced with no-ops. The originals are moved aside
+// with dpkg-divert, so packages that ship them are still installed correctly.
+var disableServicesScript = strings.Join([]string{
+	`services="$(command -v systemctl || true) $(command -v start-stop-daemon || true)"`,
+	`for f in /usr/sbin/policy-rc.d $services; do ` +
+		`dpkg-divert --quiet --local --rename --add "$f" || exit 1; done`,
+	`printf '#!/bin/sh\nexit 101\n' > /usr/sbin/policy-rc.d`,
+	`for f in $services; do printf '#!/bin/sh\nexit 0\n' > "$f"; done`,
+	`chmod 755 /usr/sbin/policy-rc.d $services`,
+}, " && ")
+
+// enableServicesScript undoes disableServicesScript, so that the stubs never
+// end up in the image.
+var enableServicesScript = strings.Join([]string{
+	`rm -f /usr/sbin/policy-rc.d $services`,
+	`for f in /usr/sbin/policy-rc.d $services; do ` +
+		`dpkg-divert --quiet --local --rename --remove "$f" || exit 1; done`,
+}, " && ")
+
+// unpackPath is where packages are extracted for `--root` and
+// `--apt-source`.
+const unpackPath = "/btidor.syntax/root"
+
+var unpackScript = "for f in /btidor.syntax/cache/archives/*.deb; do " +
+	`[ -e "$f" ] || continue; dpkg-deb -x "$f" ` + unpackPath + "; done"
+
+// sourcePath is where source package files are downloaded for
+// `--apt-source`.
+const sourcePath = "/btidor.syntax/source"
+
+// dpkgSourcePath is where the location of the image's dpkg-source, if any, is
+// stored in the temporary image for `--apt-source`.
+const dpkgSourcePath = "/btidor.syntax/dpkg-source"
+
+// unpackSourceScript extracts each source package into a directory named
+// after it, as `apt-get source` would. Signatures aren't checked, since the
+// files were verified against the repository's indexes when downloaded.
+var unpackSourceScript = "cd " + unpackPath + " && for f in " + sourcePath + "/*.dsc; do " +
+	`[ -e "$f" ] || continue; dpkg-source --no-check -x "$f"; done`
+
+// dpkgStatusScript records the unpacked packages in a minimal dpkg status
+// file, so that image scanners can find them.
+var dpkgStatusScript = strings.Join([]string{
+	"mkdir -p " + unpackPath + "/var/lib/dpkg",
+	"for f in /btidor.syntax/cache/archives/*.deb; do " +
+		`[ -e "$f" ] || continue; dpkg-deb -f "$f" Package && echo "Status: install ok installed" && ` +
+		`dpkg-deb -f "$f" Priority Section Installed-Size Maintainer Architecture ` +
+		`Multi-Arch Source Version Replaces Provides Depends Pre-Depends Breaks ` +
+		`Conflicts Description Homepage && echo; ` +
+		"done > " + unpackPath + "/var/lib/dpkg/status",
+}, " && ")
+
+var aptRegex = regexp.MustCompile(`^'([^']*)'\s+([^ ]+)\s+([0-9]+)((?:\s+[A-Za-z0-9-]+:[0-9a-fA-F]+)*)\s*$`)
 
 type PackageDownload struct {
 	uri      string
 	filename string
 	size     int
-	sha256   string
+	hashes   map[string]string // by apt's name for the hash type, e.g. "SHA256"
+}
+
+// digestAlgorithms maps the hash types printed by apt that go-digest can
+// verify, preferred first. BuildKit's HTTP source only checks SHA-256.
+var digestAlgorithms = []struct {
+	hash      string
+	algorithm digest.Algorithm
+}{
+	{"SHA256", digest.SHA256},
+	{"SHA512", digest.SHA512},
+}
+
+// digest returns the preferred verifiable digest of the package, or an empty
+// digest if apt didn't print one.
+func (p PackageDownload) digest() digest.Digest {
+	for _, alg := range digestAlgorithms {
+		if value, ok := p.hashes[alg.hash]; ok {
+			return digest.NewDigestFromEncoded(alg.algorithm, strings.ToLower(value))
+		}
+	}
+	return ""
+}
+
+// packageRecord describes a package downloaded by an `ADD --apt` command.
+type packageRecord struct {
+	PackageDownload
+	name     string
+	version  string
+	arch     string
+	vendor   string // distribution ID from os-release, e.g. "debian"
+	group    string // the `--group` the package was installed as part of
+	location []parser.Range
+}
+
+func newPackageRecord(file PackageDownload, vendor string, location []parser.Range) packageRecord {
+	var name, version, arch = parsePackageFilename(file.filename)
+	return packageRecord{file, name, version, arch, vendor, "", location}
+}
+
+// parsePackageFilename splits an archive filename of the form
+// `name_version_arch.deb`, as chosen by apt, into its parts.
+func parsePackageFilename(filename string) (name, version, arch string) {
+	var parts = strings.Split(strings.TrimSuffix(filename, ".deb"), "_")
+	if len(parts) != 3 {
+		return filename, "", ""
+	}
+	version, err := url.PathUnescape(parts[1])
+	if err != nil {
+		version = parts[1]
+	}
+	return parts[0], version, parts[2]
+}
+
+// parseOSRelease parses the KEY=value pairs in an os-release file.
+func parseOSRelease(data []byte) map[string]string {
+	var result = make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		k, v, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok || strings.HasPrefix(k, "#") {
+			continue
+		}
+		if unquoted, err := strconv.Unquote(v); err == nil {
+			v = unquoted
+		} else {
+			v = strings.Trim(v, "'")
+		}
+		result[k] = v
+	}
+	return result
+}
+
+// parseReleaseDate returns the `Date` field of a repository's Release or
+// InRelease file.
+func parseReleaseDate(data []byte) (time.Time, bool) {
+	for _, line := range strings.Split(string(data), "\n") {
+		value, ok := strings.CutPrefix(line, "Date:")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		for _, layout := range []string{time.RFC1123, time.RFC1123Z} {
+			if date, err := time.Parse(layout, value); err == nil {
+				return date, true
+			}
+		}
+		return time.Time{}, false
+	}
+	return time.Time{}, false
 }
 
 type PackageInvocation struct {
-	d    *dispatchState
-	cmd  *instructions.PackageCommand
-	dopt dispatchOpt
+	d      *dispatchState
+	cmd    *instructions.PackageCommand
+	dopt   dispatchOpt
+	mirror *dispatchState
+	from   *dispatchState
+
+	// packageFiles holds the .deb files named by the arguments, by argument
+	// index, once they've been read from the temporary image.
+	packageFiles map[int]packageRecord
 
 	updateStage, downloadStage, installStage string
 }
 
+// detectPackageSources records the stages and named contexts referenced by
+// an `ADD --apt` command, so they're resolved alongside `COPY --from` sources.
+// The mirror comes first, followed by the `--from` stage. Like base image
+// names, they're expanded with the global build args.
+func detectPackageSources(cmd *command, allDispatchStates *dispatchStates,
+	shlex *shell.Lex, globalArgs shell.EnvGetter) (bool, error) {
+
+	c, ok := cmd.Command.(*instructions.PackageCommand)
+	if !ok {
+		return false, nil
+	}
+	for _, source := range []struct {
+		flag  string
+		field *string
+	}{{"mirror", &c.Mirror}, {"from", &c.From}} {
+		if *source.field == "" {
+			continue
+		}
+		name, _, err := shlex.ProcessWord(*source.field, globalArgs)
+		if err != nil {
+			return false, parser.WithLocation(err, c.Location())
+		}
+		if name == "" {
+			return false, parser.WithLocation(errors.Errorf("empty --%s value", source.flag), c.Location())
+		}
+		*source.field = name
+		stn, ok := allDispatchStates.findStateByName(name)
+		if !ok {
+			stn = &dispatchState{
+				stage:        instructions.Stage{BaseName: name, Location: c.Location()},
+				deps:         make(map[*dispatchState]instructions.Command),
+				paths:        make(map[string]struct{}),
+				unregistered: true,
+			}
+		}
+		cmd.sources = append(cmd.sources, stn)
+	}
+	return len(cmd.sources) > 0, nil
+}
+
+// packageStepSubject describes what a package command installs, for its step
+// names.
+func packageStepSubject(c *instructions.PackageCommand) string {
+	switch {
+	case c.Upgrade:
+		return strings.Join(append([]string{"--upgrade"}, c.PackageNames...), " ")
+	case c.BuildDep:
+		return strings.Join(append([]string{"--build-dep"}, c.PackageNames...), " ")
+	default:
+		return strings.Join(c.PackageNames, " ")
+	}
+}
+
 func NewPackageInvocation(d *dispatchState, c *instructions.PackageCommand,
-	dopt dispatchOpt) *PackageInvocation {
+	sources []*dispatchState, dopt dispatchOpt) *PackageInvocation {
+
+	if c.Remove != "" {
+		// Removal is a single step.
+		var msg = fmt.Sprintf("ADD (apt remove) %s", c.Remove)
+		return &PackageInvocation{d: d, cmd: c, dopt: dopt,
+			installStage: prefixCommand(d, msg, false, nil, nil)}
+	}
 
+	var stages = []string{"update", "download", "install"}
+	if c.DownloadOnly != "" {
+		stages[2] = "export"
+	} else if c.Root != "" {
+		stages[2] = "unpack"
+	} else if c.SourceDest != "" {
+		stages[2] = "source"
+	}
 	var names [3]string
-	for i, stage := range []string{"update", "download", "install"} {
+	for i, stage := range stages {
 		// Precompute the three (`PackageStepCount`) step names. Note that
 		// `prefixCommand` increments the step counter each time it's called.
-		var msg = fmt.Sprintf("ADD (apt %s) %s", stage, strings.Join(c.PackageNames, " "))
+		var msg = fmt.Sprintf("ADD (apt %s) %s", stage, packageStepSubject(c))
 		names[i] = prefixCommand(d, msg, false, nil, nil)
 	}
-	var i = PackageInvocation{d, c, dopt, names[0], names[1], names[2]}
+	var i = PackageInvocation{d: d, cmd: c, dopt: dopt,
+		updateStage: names[0], downloadStage: names[1], installStage: names[2]}
+	if c.Mirror != "" && len(sources) > 0 {
+		i.mirror, sources = sources[0], sources[1:]
+	}
+	if c.From != "" && len(sources) > 0 {
+		i.from = sources[0]
+	}
 	return &i
 }
 
 func (i *PackageInvocation) Dispatch() error {
+	if i.cmd.Remove != "" {
+		return i.Remove()
+	}
+	if i.mirror != nil && !i.mirror.dispatched {
+		return errors.Errorf("cannot use mirror %q, stage needs to be defined before current command", i.cmd.Mirror)
+	}
+	if i.from != nil && !i.from.dispatched {
+		return errors.Errorf("cannot resolve packages with %q, stage needs to be defined before current command", i.cmd.From)
+	}
+	if i.cmd.Root != "" && i.from == nil && i.d.stage.BaseName == emptyImageName {
+		return errors.New("ADD --apt --root in a scratch stage needs --from with a stage or image that provides apt")
+	}
+	if i.cmd.SourceDest != "" && i.d.stage.BaseName == emptyImageName {
+		return errors.New("ADD --apt-source can't be used in a scratch stage, since it needs apt")
+	}
+	i.d.outline.packages = append(i.d.outline.packages, packageInfo{
+		stage:    i.d.stageName,
+		manager:  "apt",
+		names:    i.cmd.PackageNames,
+		location: i.cmd.Location(),
+	})
+	if i.cmd.Group != "" {
+		// Members are added once apt's plan shows which packages are new.
+		if i.d.packageGroups == nil {
+			i.d.packageGroups = make(map[string][]string)
+		}
+		if _, ok := i.d.packageGroups[i.cmd.Group]; !ok {
+			i.d.packageGroups[i.cmd.Group] = nil
+		}
+	}
+	if i.dopt.skipPackages {
+		return nil
+	}
+	if i.cmd.Link && i.unlinkedInstall() {
+		i.dopt.lint.Run(&linter.RuleAptLinkAfterPackageChanges, i.cmd.Location(),
+			linter.RuleAptLinkAfterPackageChanges.Format(i.d.packagesChangedAt[0].Start.Line))
+	}
+	if i.cmd.Debconf != "" {
+		// Register the selections file before the build context is first
+		// used by `Solve`.
+		i.d.ctxPaths[path.Join("/", filepath.ToSlash(i.cmd.Debconf))] = struct{}{}
+	}
+	for _, name := range i.contextFiles() {
+		i.d.ctxPaths[path.Join("/", filepath.ToSlash(name))] = struct{}{}
+	}
+	policy, err := i.dopt.packageChecks.loadPolicy(i.LoadPolicy)
+	if err != nil {
+		return parser.WithLocation(err, i.cmd.Location())
+	}
+	advisories, err := i.dopt.packageChecks.loadAdvisories(i.LoadAdvisories)
+	if err != nil {
+		return parser.WithLocation(err, i.cmd.Location())
+	}
+
 	// Run `apt-get update` with the cache volume mounted.
 	//
 	// `apt-get update` deletes unrecognized sources, so work with a local copy
 	// of the cache volume.
-	var tmp, err = i.Run(i.d.state, i.updateStage, false,
-		[]string{
-			"mkdir -p /btidor.syntax/shared/lists/partial",
-			"cp -r /btidor.syntax/shared /btidor.syntax/state",
-			fmt.Sprintf("apt-get update %s", aptions),
-			"cp -r /btidor.syntax/state/* /btidor.syntax/shared/",
-		},
+	var script []string
+	if i.mirror != nil {
+		script = append(script, mirrorSources)
+	} else if i.needsSourceIndexes() {
+		script = append(script, copySources)
+	}
+	if i.needsSourceIndexes() {
+		script = append(script, debSrcSources)
+	}
+	script = append(script,
+		"mkdir -p /btidor.syntax/shared/lists/partial",
+		"cp -r /btidor.syntax/shared /btidor.syntax/state",
+		fmt.Sprintf("apt-get update %s", i.aptOptions()),
+		"cp -r /btidor.syntax/state/* /btidor.syntax/shared/",
+	)
+	tmp, err := i.Run(i.resolver(), i.updateStage, false, script,
 		llb.AddMount("/btidor.syntax/shared", llb.Scratch(),
 			llb.AsPersistentCacheDir("btidor.syntax", llb.CacheMountLocked)),
 	)
 	if err != nil {
 		return err
 	}
+	tmp, err = i.CopyPackageFiles(tmp)
+	if err != nil {
+		return err
+	}
 
 	// Run `apt-get install --download-only` through the Docker HTTP cache and
 	// store results in the temporary image.
-	tmp, err = i.Run(tmp, i.downloadStage, false, []string{
-		fmt.Sprintf("apt-get install -qq --print-uris %s %s "+
-			"> /btidor.syntax/install", aptions, strings.Join(i.cmd.PackageNames, " ")),
-	})
+	//
+	// Packages for an alternate root or an offline bundle are resolved
+	// against an empty dpkg status, so that every dependency is downloaded.
+	var downloadOptions = i.aptOptions()
+	script = nil
+	if i.resolvesFromScratch() {
+		downloadOptions += " --option Dir::State::status=/btidor.syntax/status"
+		script = append(script, ": > /btidor.syntax/status")
+	}
+
+	// If resolution fails, the step still succeeds, so that apt's errors can
+	// be reported against the Dockerfile. On success, the full plan is
+	// recorded, so that removals and downgrades can be checked before
+	// anything is installed, along with the dependencies of the resolved
+	// packages if there's a policy to explain violations of, and their
+	// source packages if there's an advisory database to check.
+	var resolved []string
+	if i.installs() {
+		resolved = append(resolved, fmt.Sprintf("apt-get %s --simulate "+
+			"--allow-remove-essential --allow-downgrades %s %s > %s",
+			i.aptAction(), downloadOptions, i.packageArgs(), planPath))
+	}
+	if policy != nil && i.cmd.SourceDest == "" {
+		resolved = append(resolved, i.dependsScript())
+	}
+	if advisories != nil && i.cmd.SourceDest == "" {
+		resolved = append(resolved, i.showScript())
+	}
+	if len(resolved) == 0 {
+		resolved = append(resolved, ":")
+	}
+	if slices.ContainsFunc(i.cmd.PackageNames, instructions.IsPackageFile) {
+		script = append(script, packageFilesScript)
+	}
+	script = append(script,
+		fmt.Sprintf("if apt-get %s -qq --print-uris %s %s "+
+			"> /btidor.syntax/install 2> %s; then %s; "+
+			"else { apt-cache %s pkgnames || true; } > %s; fi",
+			i.aptAction(), downloadOptions, i.packageArgs(), resolveErrorsPath,
+			strings.Join(resolved, " && "), i.listsOptions(), pkgnamesPath),
+		fmt.Sprintf("cat %s >&2", resolveErrorsPath),
+		"{ cat /etc/os-release || true; } > /btidor.syntax/os-release",
+	)
+	if i.cmd.SourceDest != "" {
+		script = append(script, fmt.Sprintf("{ command -v dpkg-source || true; } > %s", dpkgSourcePath))
+	}
+	tmp, err = i.Run(tmp, i.downloadStage, false, script)
+	if err != nil {
+		return err
+	}
+	ref, err := i.Solve(tmp)
 	if err != nil {
 		return err
 	}
-	data, err := i.ReadFile(tmp, "/btidor.syntax/install")
+	err = i.ResolveError(ref)
+	if err != nil {
+		return err
+	}
+	if i.cmd.SourceDest != "" {
+		data, err := i.ReadFile(ref, dpkgSourcePath)
+		if err != nil {
+			return err
+		}
+		err = i.CheckDpkgSource(data)
+		if err != nil {
+			return err
+		}
+	}
+	data, err := i.ReadFile(ref, "/btidor.syntax/install")
 	if err != nil {
 		return err
 	}
@@ -94,26 +551,613 @@ func (i *PackageInvocation) Dispatch() error {
 	if err != nil {
 		return err
 	}
+	if slices.ContainsFunc(i.cmd.PackageNames, instructions.IsPackageFile) {
+		data, err = i.ReadFile(ref, packageFilesPath)
+		if err != nil {
+			return err
+		}
+		i.packageFiles = i.parsePackageFiles(data)
+	}
+	err = i.CheckDownloadSize(uris)
+	if err != nil {
+		return err
+	}
+	if policy != nil {
+		var deps map[string][]string
+		if i.cmd.SourceDest == "" {
+			data, err = i.ReadFile(ref, dependsPath)
+			if err != nil {
+				return err
+			}
+			deps = parseDependencies(data)
+		}
+		err = i.CheckPolicy(policy, uris, deps)
+		if err != nil {
+			return err
+		}
+	}
+	if advisories != nil && i.cmd.SourceDest == "" {
+		data, err = i.ReadFile(ref, showPath)
+		if err != nil {
+			return err
+		}
+		var sources = parseSourcePackages(data)
+		if i.packageFiles != nil {
+			data, err = i.ReadFile(ref, packageFilesPath)
+			if err != nil {
+				return err
+			}
+			maps.Copy(sources, parseSourcePackages(data))
+		}
+		data, err = i.ReadFile(ref, "/btidor.syntax/os-release")
+		if err != nil {
+			return err
+		}
+		err = i.CheckAdvisories(advisories, uris, sources, parseOSRelease(data))
+		if err != nil {
+			return err
+		}
+	}
+	var newPackages []string
+	if i.installs() {
+		data, err = i.ReadFile(ref, planPath)
+		if err != nil {
+			return err
+		}
+		err = i.CheckPlan(data)
+		if err != nil {
+			return err
+		}
+		newPackages = parseNewPackages(data)
+		if i.cmd.Group != "" {
+			i.d.packageGroups[i.cmd.Group] = append(
+				slices.Clone(i.d.packageGroups[i.cmd.Group]), newPackages...)
+		}
+	}
+	if i.cmd.SourceDest != "" {
+		tmp, err = i.DownloadFiles(tmp, uris, sourcePath+"/")
+		if err != nil {
+			return err
+		}
+		return i.UnpackSource(tmp)
+	}
 	tmp, err = i.DownloadFiles(tmp, uris, "/btidor.syntax/cache/archives/")
 	if err != nil {
 		return err
 	}
+	if i.cmd.DownloadOnly != "" {
+		return i.Export(tmp)
+	}
+
+	// Remember what was installed, for the SBOM.
+	data, err = i.ReadFile(ref, "/btidor.syntax/os-release")
+	if err != nil {
+		return err
+	}
+	var vendor = parseOSRelease(data)["ID"]
+	var records []packageRecord
+	for _, uri := range uris {
+		records = append(records, newPackageRecord(uri, vendor, i.cmd.Location()))
+	}
+	if i.installs() {
+		// apt installs .deb files in place, rather than from its archives,
+		// so they're only part of installs.
+		for _, n := range slices.Sorted(maps.Keys(i.packageFiles)) {
+			records = append(records, i.packageFiles[n])
+		}
+	}
+	for _, record := range records {
+		if slices.ContainsFunc(newPackages, func(name string) bool {
+			name, _, _ = strings.Cut(name, ":")
+			return name == record.name
+		}) {
+			record.group = i.cmd.Group
+		}
+		i.d.packages = append(i.d.packages, record)
+	}
+	if i.cmd.Root != "" {
+		return i.Unpack(tmp)
+	}
+	defer func() { i.d.packagesChangedAt = i.cmd.Location() }()
 
 	// Run `apt-get install --no-download` in the original image. The temporary
 	// image is used as a mount point to provide the sources and cache.
-	i.d.state, err = i.Run(i.d.state, i.installStage, true,
-		[]string{
-			fmt.Sprintf("apt-get install --no-download %s %s",
-				aptions, strings.Join(i.cmd.PackageNames, " ")),
-		},
-		llb.AddMount("/btidor.syntax", tmp, llb.SourcePath("/btidor.syntax")),
-	)
+	tmp, script = i.Debconf(tmp)
+	script = withServicesDisabled(append(script, fmt.Sprintf("apt-get %s --no-download %s%s%s %s",
+		i.aptAction(), i.aptOptions(), i.allowOptions(), i.slimOptions(), i.packageArgs())))
+	if !i.cmd.KeepLists {
+		return i.RunLayer(script,
+			llb.AddMount("/btidor.syntax", tmp, llb.SourcePath("/btidor.syntax")))
+	}
+
+	// With `--keep-lists`, copy the lists used for resolution into the image
+	// and label it with their date.
+	listsDate, err := i.ListsDate(ref)
+	if err != nil {
+		return err
+	}
+	script = append(script, keepListsScript)
+	err = i.RunLayer(script,
+		llb.AddMount("/btidor.syntax", tmp, llb.SourcePath("/btidor.syntax")))
+	if err != nil || listsDate.IsZero() {
+		return err
+	}
+	if i.d.image.Config.Labels == nil {
+		i.d.image.Config.Labels = make(map[string]string)
+	}
+	i.d.image.Config.Labels[listsDateLabel] = listsDate.UTC().Format(time.RFC3339)
+	return nil
+}
+
+// withServicesDisabled wraps a script that runs maintainer scripts, so that
+// they can't start or stop services while it runs.
+func withServicesDisabled(script []string) []string {
+	var wrapped = []string{disableServicesScript}
+	wrapped = append(wrapped, script...)
+	return append(wrapped, enableServicesScript)
+}
+
+// ListsDate returns the date of the newest repository index used for
+// resolution, or the zero time if it can't be determined.
+func (i *PackageInvocation) ListsDate(ref client.Reference) (time.Time, error) {
+	const dir = "/btidor.syntax/state/lists"
+	stats, err := ref.ReadDir(i.dopt.context, client.ReadDirRequest{
+		Path:           dir,
+		IncludePattern: "*Release",
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	var latest time.Time
+	for _, st := range stats {
+		data, err := i.ReadFile(ref, path.Join(dir, st.GetPath()))
+		if err != nil {
+			return time.Time{}, err
+		}
+		if date, ok := parseReleaseDate(data); ok && date.After(latest) {
+			latest = date
+		}
+	}
+	return latest, nil
+}
+
+// Debconf adds the `--debconf` selections to the temporary image, and returns
+// the commands that load them before installing. The selections are part of
+// the install step's cache key, but aren't left in the image.
+func (i *PackageInvocation) Debconf(tmp llb.State) (llb.State, []string) {
+	var files []string
+	if i.cmd.Debconf != "" {
+		var dest = path.Join(debconfPath, "context")
+		tmp = tmp.File(llb.Copy(i.dopt.buildContext, i.cmd.Debconf, dest,
+			&llb.CopyInfo{CreateDestPath: true}),
+			dfCmd(i.cmd), location(i.dopt.sourceMap, i.cmd.Location()))
+		files = append(files, dest)
+	}
+	for n, selections := range i.cmd.DebconfHeredocs {
+		var dest = path.Join(debconfPath, fmt.Sprintf("heredoc-%d", n))
+		tmp = tmp.File(llb.Mkdir(debconfPath, 0o755, llb.WithParents(true)).
+			Mkfile(dest, 0o644, []byte(selections)),
+			dfCmd(i.cmd), location(i.dopt.sourceMap, i.cmd.Location()))
+		files = append(files, dest)
+	}
+	if len(files) == 0 {
+		return tmp, nil
+	}
+	return tmp, []string{"debconf-set-selections " + strings.Join(files, " ")}
+}
+
+// Remove purges the members of a package group, along with any dependencies
+// that are no longer needed.
+func (i *PackageInvocation) Remove() error {
+	var members, ok = i.d.packageGroups[i.cmd.Remove]
+	if !ok {
+		var groups = slices.Sorted(maps.Keys(i.d.packageGroups))
+		return suggest.WrapError(errors.Errorf("package group %q could not be found", i.cmd.Remove),
+			i.cmd.Remove, groups, true)
+	}
+	delete(i.d.packageGroups, i.cmd.Remove)
+	i.d.packages = slices.DeleteFunc(slices.Clone(i.d.packages), func(p packageRecord) bool {
+		return p.group == i.cmd.Remove
+	})
+	if i.dopt.skipPackages {
+		return nil
+	}
+
+	if len(members) == 0 {
+		return nil
+	}
+
+	// Mark the packages the group installed as automatically installed, and
+	// purge the ones that nothing else needs anymore. Other packages that apt
+	// could autoremove are left alone.
+	var names, patterns []string
+	for _, member := range members {
+		names = append(names, shellQuote(member))
+		patterns = append(patterns, "-e "+shellQuote(member))
+	}
+	var err error
+	i.d.state, err = i.Run(i.d.state, i.installStage, true, withServicesDisabled([]string{
+		fmt.Sprintf("apt-mark auto --quiet %s > /dev/null", strings.Join(names, " ")),
+		fmt.Sprintf("apt-get autoremove --purge --simulate --quiet | "+
+			"sed -n 's/^Purg \\([^ ]*\\).*/\\1/p' | grep -Fx %s | "+
+			"xargs -r apt-get purge --yes --quiet", strings.Join(patterns, " ")),
+	}))
+	i.d.packagesChangedAt = i.cmd.Location()
 	return err
 }
 
+// Export copies the downloaded packages into the `--download-only` directory
+// of the original image, optionally along with a repository index.
+func (i *PackageInvocation) Export(tmp llb.State) error {
+	dest, err := pathRelativeToWorkingDir(i.d.state, i.cmd.DownloadOnly, *i.d.platform)
+	if err != nil {
+		return err
+	}
+	var script = []string{
+		fmt.Sprintf("mkdir -p %s", shellQuote(dest)),
+		fmt.Sprintf("find /btidor.syntax/cache/archives -maxdepth 1 -name '*.deb' "+
+			"-exec cp -t %s {} +", shellQuote(dest)),
+	}
+	if i.cmd.Index {
+		script = append(script, fmt.Sprintf("cd %s", shellQuote(dest)), packageIndexScript)
+	}
+	return i.RunLayer(script,
+		llb.AddMount("/btidor.syntax", tmp, llb.SourcePath("/btidor.syntax"), llb.Readonly))
+}
+
+// RunLayer runs the final step, which produces the package layer, on the
+// original image. With `--link`, the step runs on the stage's base instead,
+// and its changes are merged on top of the original image.
+func (i *PackageInvocation) RunLayer(script []string, extra ...llb.RunOption) error {
+	if !i.linked() {
+		var next, err = i.Run(i.d.state, i.installStage, true, script, extra...)
+		i.d.state = next
+		return err
+	}
+	var pgID = identity.NewID()
+	var base = i.linkedBase()
+	var next, err = i.Run(base, i.installStage, true, script,
+		append(extra, llb.ProgressGroup(pgID, i.installStage, true))...)
+	if err != nil {
+		return err
+	}
+	var diff = llb.Diff(base, next, i.linkOptions(pgID)...)
+	i.d.state = i.d.state.WithOutput(
+		llb.Merge([]llb.State{i.d.state, diff}, i.linkOptions(pgID)...).Output())
+	return nil
+}
+
+// Unpack extracts the downloaded packages into the `--root` directory of the
+// original image. Extraction happens in the resolving image, so the original
+// image doesn't need apt or dpkg.
+func (i *PackageInvocation) Unpack(tmp llb.State) error {
+	dest, err := pathRelativeToWorkingDir(i.d.state, i.cmd.Root, *i.d.platform)
+	if err != nil {
+		return err
+	}
+	var script = []string{unpackScript}
+	if i.cmd.DpkgStatus {
+		script = append(script, dpkgStatusScript)
+	}
+	var es = tmp.Run(i.runOptions(i.installStage, script)...)
+	return i.CopyLayer(es.AddMount(unpackPath, llb.Scratch()), dest)
+}
+
+// CheckDpkgSource fails the build before anything is downloaded if the image
+// doesn't have dpkg-source, which `--apt-source` unpacks with. data is the
+// output of `command -v dpkg-source`.
+func (i *PackageInvocation) CheckDpkgSource(data []byte) error {
+	if strings.TrimSpace(string(data)) != "" {
+		return nil
+	}
+	var err = errors.New("ADD --apt-source needs dpkg-source in the image; " +
+		"install dpkg-dev first, e.g. with ADD --apt dpkg-dev")
+	return parser.WithLocation(err, i.cmd.Location())
+}
+
+// UnpackSource extracts the downloaded source packages with `dpkg-source -x`
+// into the `--apt-source` directory of the original image. Extraction happens
+// in the temporary image, which is built on the stage's image, so that image
+// needs dpkg-source; see CheckDpkgSource.
+func (i *PackageInvocation) UnpackSource(tmp llb.State) error {
+	dest, err := pathRelativeToWorkingDir(i.d.state, i.cmd.SourceDest, *i.d.platform)
+	if err != nil {
+		return err
+	}
+	var es = tmp.Run(i.runOptions(i.installStage, []string{unpackSourceScript})...)
+	return i.CopyLayer(es.AddMount(unpackPath, llb.Scratch()), dest)
+}
+
+// CopyLayer copies the contents of root into the dest directory of the
+// original image, as the package layer.
+func (i *PackageInvocation) CopyLayer(root llb.State, dest string) error {
+	var copyAction = llb.Copy(root, "/", dest, &llb.CopyInfo{
+		CopyDirContentsOnly: true,
+		CreateDestPath:      true,
+	})
+	var fileOpts = []llb.ConstraintsOpt{
+		dfCmd(i.cmd),
+		location(i.dopt.sourceMap, i.cmd.Location()),
+		llb.WithCustomName(i.installStage),
+	}
+	if i.linked() {
+		var pgID = identity.NewID()
+		var layer = llb.Scratch().File(copyAction,
+			append(fileOpts, llb.ProgressGroup(pgID, i.installStage, true))...)
+		i.d.state = i.d.state.WithOutput(
+			llb.Merge([]llb.State{i.d.state, layer}, i.linkOptions(pgID)...).Output())
+	} else {
+		i.d.state = i.d.state.File(copyAction, fileOpts...)
+	}
+	return commitToHistory(&i.d.image, i.installStage, true, &i.d.state, i.d.epoch)
+}
+
+// resolver returns the state in which apt resolves and downloads packages.
+func (i *PackageInvocation) resolver() llb.State {
+	if i.from != nil {
+		return i.from.state
+	}
+	if i.linked() {
+		return i.linkedBase()
+	}
+	return i.d.state
+}
+
+// linked reports whether `--link` is in effect. Like `COPY --link`, it falls
+// back to a regular layer when BuildKit can't merge and diff states. Installs
+// also fall back after an earlier command in the stage may have changed the
+// installed packages, since the linked layer's dpkg and apt state would
+// replace the changes.
+func (i *PackageInvocation) linked() bool {
+	return i.cmd.Link && i.dopt.llbCaps != nil &&
+		i.dopt.llbCaps.Supports(pb.CapMergeOp) == nil &&
+		i.dopt.llbCaps.Supports(pb.CapDiffOp) == nil &&
+		!i.unlinkedInstall()
+}
+
+// unlinkedInstall reports whether `--link` is ignored for an install because
+// an earlier command in the stage may have changed the installed packages.
+func (i *PackageInvocation) unlinkedInstall() bool {
+	return i.installs() && i.d.packagesChangedAt != nil
+}
+
+// linkedBase returns the stage's base filesystem with the current metadata
+// (environment, working directory and user).
+func (i *PackageInvocation) linkedBase() llb.State {
+	return i.d.state.WithOutput(i.d.linkBase.Output())
+}
+
+func (i *PackageInvocation) linkOptions(pgID string) []llb.ConstraintsOpt {
+	return []llb.ConstraintsOpt{
+		dfCmd(i.cmd),
+		location(i.dopt.sourceMap, i.cmd.Location()),
+		llb.WithCustomName(i.installStage),
+		llb.ProgressGroup(pgID, i.installStage, false),
+	}
+}
+
+// aptAction returns the apt-get command that resolves and installs the
+// packages. With `--upgrade`, dist-upgrade also installs any named packages.
+func (i *PackageInvocation) aptAction() string {
+	switch {
+	case i.cmd.Upgrade:
+		return "dist-upgrade"
+	case i.cmd.BuildDep:
+		return "build-dep"
+	case i.cmd.SourceDest != "":
+		return "source"
+	default:
+		return "install"
+	}
+}
+
+// isControlFile reports whether a `--build-dep` argument names a
+// debian/control file in the build context rather than a source package.
+func isControlFile(name string) bool {
+	return strings.Contains(name, "/") && path.Base(name) == "control"
+}
+
+// contextFiles returns the files in the build context that the command's
+// arguments name: debian/control files for `--build-dep`, and .deb files.
+func (i *PackageInvocation) contextFiles() []string {
+	var files []string
+	for _, name := range i.cmd.PackageNames {
+		if (i.cmd.BuildDep && isControlFile(name)) ||
+			(instructions.IsPackageFile(name) && !instructions.IsPackageURL(name)) {
+			files = append(files, name)
+		}
+	}
+	return files
+}
+
+// CopyPackageFiles copies the files named by the command's arguments into
+// the temporary image: debian/control files for `--build-dep` and .deb files
+// from the build context, and .deb files from URLs.
+func (i *PackageInvocation) CopyPackageFiles(tmp llb.State) (llb.State, error) {
+	for n, name := range i.cmd.PackageNames {
+		var src, dest = i.dopt.buildContext, i.packageArg(n, name)
+		switch {
+		case i.cmd.BuildDep && isControlFile(name):
+			dest = path.Join(dest, "debian", "control")
+		case instructions.IsPackageURL(name):
+			var httpOpts = []llb.HTTPOption{
+				llb.Filename(path.Base(dest)),
+				llb.WithCustomNamef("[apt] %s", name),
+				dfCmd(i.cmd),
+				location(i.dopt.sourceMap, i.cmd.Location()),
+			}
+			if i.cmd.Checksum != "" {
+				checksum, err := digest.Parse(i.cmd.Checksum)
+				if err != nil {
+					return llb.State{}, parser.WithLocation(err, i.cmd.Location())
+				}
+				httpOpts = append(httpOpts, llb.Checksum(checksum))
+			}
+			src, name = llb.HTTP(name, httpOpts...), path.Base(dest)
+		case !instructions.IsPackageFile(name):
+			continue
+		}
+		tmp = tmp.File(llb.Copy(src, name, dest, &llb.CopyInfo{CreateDestPath: true}),
+			dfCmd(i.cmd), location(i.dopt.sourceMap, i.cmd.Location()))
+	}
+	return tmp, nil
+}
+
+// packageArg returns the apt-get argument for one of the command's
+// arguments. debian/control files are passed as the source trees they were
+// copied into, and .deb files as their paths in the temporary image.
+func (i *PackageInvocation) packageArg(n int, name string) string {
+	switch {
+	case i.cmd.BuildDep && isControlFile(name):
+		return path.Join(buildDepPath, strconv.Itoa(n)) + "/"
+	case instructions.IsPackageFile(name):
+		return path.Join(debPath, strconv.Itoa(n), path.Base(name))
+	default:
+		return name
+	}
+}
+
+// packageArgs returns the arguments for apt-get, see packageArg.
+func (i *PackageInvocation) packageArgs() string {
+	var args []string
+	for n, name := range i.cmd.PackageNames {
+		args = append(args, i.packageArg(n, name))
+	}
+	return strings.Join(args, " ")
+}
+
+// parsePackageFiles parses the output of packageFilesScript into records for
+// the .deb files, by the index of the argument that named them. Files from
+// the build context have no URI.
+func (i *PackageInvocation) parsePackageFiles(data []byte) map[int]packageRecord {
+	var files = make(map[int]packageRecord)
+	for _, stanza := range strings.Split(string(data), "\n\n") {
+		var fields = parseControlStanza(stanza)
+		var rel, _ = strings.CutPrefix(fields["Filename"], debPath+"/")
+		var index, _, _ = strings.Cut(rel, "/")
+		n, err := strconv.Atoi(index)
+		if err != nil || n < 0 || n >= len(i.cmd.PackageNames) || fields["Package"] == "" {
+			continue
+		}
+		var arg = i.cmd.PackageNames[n]
+		var file = PackageDownload{filename: path.Base(arg)}
+		if instructions.IsPackageURL(arg) {
+			file.uri = arg
+		}
+		if fields["SHA256"] != "" {
+			file.hashes = map[string]string{"SHA256": fields["SHA256"]}
+		}
+		files[n] = packageRecord{
+			PackageDownload: file,
+			name:            fields["Package"],
+			version:         fields["Version"],
+			arch:            fields["Architecture"],
+			location:        i.cmd.Location(),
+		}
+	}
+	return files
+}
+
+// checkedPackages returns records for the packages to be downloaded, followed
+// by the .deb files named by the command, for checks before installing.
+func (i *PackageInvocation) checkedPackages(files []PackageDownload) []packageRecord {
+	var records []packageRecord
+	for _, file := range files {
+		records = append(records, newPackageRecord(file, "", nil))
+	}
+	for _, n := range slices.Sorted(maps.Keys(i.packageFiles)) {
+		records = append(records, i.packageFiles[n])
+	}
+	return records
+}
+
+// parseControlStanza parses the fields of one stanza in a Debian control
+// file. Continuation lines are skipped.
+func parseControlStanza(stanza string) map[string]string {
+	var fields = make(map[string]string)
+	for _, line := range strings.Split(stanza, "\n") {
+		if name, value, ok := strings.Cut(line, ":"); ok && !strings.HasPrefix(line, " ") {
+			fields[name] = strings.TrimSpace(value)
+		}
+	}
+	return fields
+}
+
+// resolvesFromScratch reports whether packages are resolved as if nothing
+// were installed: for `--root`, and for `--download-only` bundles, which
+// must carry every dependency to be installable elsewhere. Upgrades are
+// resolved against the installed packages, since that's what they upgrade.
+func (i *PackageInvocation) resolvesFromScratch() bool {
+	return i.cmd.Root != "" || (i.cmd.DownloadOnly != "" && !i.cmd.Upgrade)
+}
+
+// installs reports whether the packages are installed into the image, rather
+// than exported or unpacked.
+func (i *PackageInvocation) installs() bool {
+	return i.cmd.DownloadOnly == "" && i.cmd.Root == "" && i.cmd.SourceDest == ""
+}
+
+// aptOptions returns the options passed to every apt-get invocation.
+func (i *PackageInvocation) aptOptions() string {
+	if !i.rewritesSources() {
+		return aptions
+	}
+	return aptions + copiedSourcesOptions
+}
+
+// rewritesSources reports whether apt reads sources from the copies in the
+// temporary image rather than from the image's configuration.
+func (i *PackageInvocation) rewritesSources() bool {
+	return i.mirror != nil || i.needsSourceIndexes()
+}
+
+// needsSourceIndexes reports whether apt needs deb-src entries to resolve
+// the command.
+func (i *PackageInvocation) needsSourceIndexes() bool {
+	return i.cmd.BuildDep || i.cmd.SourceDest != ""
+}
+
+// listsOptions returns the options that point apt-cache at the package lists
+// used for resolution.
+func (i *PackageInvocation) listsOptions() string {
+	var opts = "--option Dir::Cache=/btidor.syntax/cache" +
+		" --option Dir::State::lists=/btidor.syntax/state/lists/"
+	if !i.rewritesSources() {
+		return opts
+	}
+	return opts + copiedSourcesOptions
+}
+
+// slimOptions returns the apt-get options that keep the `--slim` categories
+// out of the image. Excludes come first, since dpkg applies the last matching
+// filter.
+func (i *PackageInvocation) slimOptions() string {
+	var excludes, includes []string
+	for _, category := range i.cmd.Slim {
+		excludes = append(excludes, slimFilters[category].exclude...)
+		includes = append(includes, slimFilters[category].include...)
+	}
+	var opts strings.Builder
+	for _, filter := range excludes {
+		fmt.Fprintf(&opts, " --option %s", shellQuote("DPkg::Options::=--path-exclude="+filter))
+	}
+	for _, filter := range includes {
+		fmt.Fprintf(&opts, " --option %s", shellQuote("DPkg::Options::=--path-include="+filter))
+	}
+	return opts.String()
+}
+
 func (i *PackageInvocation) Run(state llb.State, stageName string, withLayer bool,
 	script []string, extra ...llb.RunOption) (llb.State, error) {
 
+	var next = state.Run(i.runOptions(stageName, script, extra...)...).Root()
+	var err = commitToHistory(&i.d.image, stageName, withLayer, &next, i.d.epoch)
+	return next, err
+}
+
+func (i *PackageInvocation) runOptions(stageName string, script []string,
+	extra ...llb.RunOption) []llb.RunOption {
+
 	// Options collected from `dispatchRun()`
 	var opts = []llb.RunOption{
 		llb.AddEnv("DEBIAN_FRONTEND", "noninteractive"),
@@ -125,14 +1169,18 @@ func (i *PackageInvocation) Run(state llb.State, stageName string, withLayer boo
 	if i.d.ignoreCache {
 		opts = append(opts, llb.IgnoreCache)
 	}
-	opts = append(opts, extra...)
-	var next = state.Run(opts...).Root()
-
-	var err = commitToHistory(&i.d.image, stageName, withLayer, &next, i.d.epoch)
-	return next, err
+	if i.mirror != nil {
+		// Everything comes from the mirror, so there's no need for network
+		// access. This also catches misconfigured sources early.
+		opts = append(opts,
+			llb.Network(llb.NetModeNone),
+			llb.AddMount(mirrorPath, i.mirror.state, llb.Readonly),
+		)
+	}
+	return append(opts, extra...)
 }
 
-func (i *PackageInvocation) ReadFile(state llb.State, path string) ([]byte, error) {
+func (i *PackageInvocation) Solve(state llb.State) (client.Reference, error) {
 	// Unfortunately, this spooky action at a distance is required for state
 	// marshalling to succeed in some cases. We're copying the behavior from the
 	// very end of `toDispatchState()`.
@@ -148,8 +1196,8 @@ func (i *PackageInvocation) ReadFile(state llb.State, path string) ([]byte, erro
 
 	state = state.SetMarshalDefaults(llb.Platform(i.dopt.targetPlatform))
 
-	// Send the current state to be executed, then read the given file from the
-	// layer.
+	// Send the current state to be executed, so files can be read from the
+	// resulting layer.
 	def, err := state.Marshal(i.dopt.context)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to marshal LLB definition")
@@ -161,13 +1209,16 @@ func (i *PackageInvocation) ReadFile(state llb.State, path string) ([]byte, erro
 	if err != nil {
 		return nil, err
 	}
-	ref, err := res.SingleRef()
-	if err != nil {
-		return nil, err
-	}
+	return res.SingleRef()
+}
+
+func (i *PackageInvocation) ReadFile(ref client.Reference, path string) ([]byte, error) {
 	return ref.ReadFile(i.dopt.context, client.ReadRequest{Filename: path})
 }
 
+// ParseURIs parses the output of `apt-get --print-uris`. apt also prints the
+// .deb files named by the command, which are already in the temporary image
+// and are tracked as packageFiles instead, so they're left out.
 func (i *PackageInvocation) ParseURIs(uris []byte) ([]PackageDownload, error) {
 	var results []PackageDownload
 	for _, line := range strings.Split(string(uris), "\n") {
@@ -179,15 +1230,22 @@ func (i *PackageInvocation) ParseURIs(uris []byte) ([]PackageDownload, error) {
 		if match == nil {
 			return nil, errors.Errorf("could not parse apt uri line: %q", line)
 		}
+		if strings.HasPrefix(match[1], "file:"+debPath+"/") {
+			continue
+		}
 		size, err := strconv.Atoi(match[3])
 		if err != nil {
 			return nil, err
 		}
-		sha256 := ""
-		if len(match) > 5 {
-			sha256 = match[5]
+		var hashes map[string]string
+		for _, field := range strings.Fields(match[4]) {
+			if hashes == nil {
+				hashes = make(map[string]string)
+			}
+			name, value, _ := strings.Cut(field, ":")
+			hashes[strings.ToUpper(name)] = value
 		}
-		results = append(results, PackageDownload{match[1], match[2], size, sha256})
+		results = append(results, PackageDownload{match[1], match[2], size, hashes})
 	}
 	return results, nil
 }
@@ -195,30 +1253,125 @@ func (i *PackageInvocation) ParseURIs(uris []byte) ([]PackageDownload, error) {
 func (i *PackageInvocation) DownloadFiles(base llb.State, files []PackageDownload,
 	destination string) (llb.State, error) {
 
+	// Nothing is downloaded when everything is already installed and up to
+	// date, e.g. for `--upgrade` on a patched image.
+	if len(files) == 0 {
+		return base, nil
+	}
 	var action *llb.FileAction
 	var mode = llb.ChmodOpt{Mode: os.FileMode(0o644)}
 	var copyOpt = &llb.CopyInfo{
 		Mode:           &mode,
 		CreateDestPath: true,
 	}
+	var sums = make(map[digest.Algorithm][]string)
 	for _, file := range files {
-		var httpOpts = []llb.HTTPOption{
-			llb.Filename(file.filename),
-		}
-		if file.sha256 != "" {
-			httpOpts = append(httpOpts, llb.Checksum(
-				digest.NewDigestFromEncoded(digest.SHA256, file.sha256)))
+		var src, srcPath, destPath = llb.State{}, file.filename, destination
+		if rel, ok := strings.CutPrefix(file.uri, "file:"); ok {
+			// Packages from the mirror are copied directly out of the
+			// mirror's state, and verified once they've been copied.
+			rel, ok = strings.CutPrefix(rel, mirrorPath+"/")
+			if !ok || i.mirror == nil {
+				return llb.State{}, errors.Errorf("unexpected local package uri: %q", file.uri)
+			}
+			unescaped, err := url.PathUnescape(rel)
+			if err != nil {
+				return llb.State{}, errors.Wrapf(err, "invalid package uri: %q", file.uri)
+			}
+			src, srcPath = i.mirror.state, path.Join("/", unescaped)
+			destPath = path.Join(destination, file.filename)
+			if dgst := file.digest(); dgst != "" {
+				sums[dgst.Algorithm()] = append(sums[dgst.Algorithm()],
+					fmt.Sprintf("%s  %s", dgst.Encoded(), destPath))
+			} else if err := i.checkUnverified(file); err != nil {
+				return llb.State{}, err
+			}
+		} else {
+			// Label each download with its package and originating
+			// instruction, so that provenance attestations can tie the
+			// material back to the `ADD --apt` line.
+			var name, version, arch = parsePackageFilename(file.filename)
+			var httpOpts = []llb.HTTPOption{
+				llb.Filename(file.filename),
+				llb.WithCustomNamef("[apt] %s %s", name, version),
+				dfCmd(i.cmd),
+				llb.WithDescription(map[string]string{
+					packageDescriptionKey:           fmt.Sprintf("%s=%s", name, version),
+					packageDescriptionKey + ".arch": arch,
+					packageDescriptionKey + ".uri":  file.uri,
+				}),
+				location(i.dopt.sourceMap, i.cmd.Location()),
+			}
+			var dgst = file.digest()
+			switch {
+			case dgst == "":
+				if err := i.checkUnverified(file); err != nil {
+					return llb.State{}, err
+				}
+			case dgst.Algorithm() == digest.SHA256:
+				httpOpts = append(httpOpts, llb.Checksum(dgst))
+			default:
+				// Other digests are verified once the package is downloaded.
+				sums[dgst.Algorithm()] = append(sums[dgst.Algorithm()],
+					fmt.Sprintf("%s  %s", dgst.Encoded(), path.Join(destination, file.filename)))
+			}
+			src = llb.HTTP(file.uri, httpOpts...)
 		}
-		http := llb.HTTP(file.uri, httpOpts...)
 		if action == nil {
-			action = llb.Copy(http, file.filename, destination, copyOpt)
+			action = llb.Copy(src, srcPath, destPath, copyOpt)
 		} else {
-			action = action.Copy(http, file.filename, destination, copyOpt)
+			action = action.Copy(src, srcPath, destPath, copyOpt)
 		}
 	}
-	return base.File(action,
+	base = base.File(action,
 		dfCmd(i.cmd),
 		location(i.dopt.sourceMap, i.cmd.Location()),
-		llb.WithCustomName("COPY (apt packages)"),
-	), nil
+		llb.WithCustomNamef("COPY (apt packages) %s", downloadSummary(files)),
+	)
+	return i.verifyFiles(base, sums), nil
+}
+
+// requireDigest reports whether packages without a verifiable digest should
+// fail the build, as requested with BUILDKIT_APT_REQUIRE_DIGEST.
+func (i *PackageInvocation) requireDigest() bool {
+	v, ok := i.dopt.buildArgValues[aptRequireDigest]
+	return ok && isEnabledForStage(i.d.stageName, v)
+}
+
+// checkUnverified fails the build for a package without a verifiable digest
+// if BUILDKIT_APT_REQUIRE_DIGEST is set, and warns otherwise.
+func (i *PackageInvocation) checkUnverified(file PackageDownload) error {
+	if i.requireDigest() {
+		return parser.WithLocation(errors.Errorf(
+			"package %s has no SHA-256 or SHA-512 digest to verify it with", file.filename),
+			i.cmd.Location())
+	}
+	i.dopt.lint.Run(&linter.RuleAptPackageWithoutDigest, i.cmd.Location(),
+		linter.RuleAptPackageWithoutDigest.Format(file.filename))
+	return nil
+}
+
+// verifyFiles checks packages against the digests printed by apt, for those
+// that BuildKit doesn't verify itself: copies from the mirror, and downloads
+// with only a SHA-512 digest. sums holds `sha256sum`-style lines by
+// algorithm.
+func (i *PackageInvocation) verifyFiles(tmp llb.State, sums map[digest.Algorithm][]string) llb.State {
+	if len(sums) == 0 {
+		return tmp
+	}
+	var script []string
+	for _, alg := range digestAlgorithms {
+		if len(sums[alg.algorithm]) == 0 {
+			continue
+		}
+		var list = path.Join("/btidor.syntax", string(alg.algorithm)+"sums")
+		tmp = tmp.File(llb.Mkfile(list, 0o644, []byte(strings.Join(sums[alg.algorithm], "\n")+"\n")),
+			dfCmd(i.cmd), location(i.dopt.sourceMap, i.cmd.Location()))
+		script = append(script, fmt.Sprintf("%ssum --check --quiet %s", alg.algorithm, list))
+	}
+	return tmp.Run(i.runOptions("[apt] verify packages", script)...).Root()
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
 }
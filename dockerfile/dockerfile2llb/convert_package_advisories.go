@@ -0,0 +1,549 @@
+package dockerfile2llb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/btidor/syntax/dockerfile/linter"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/moby/buildkit/frontend/dockerui"
+	"github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/pkg/errors"
+)
+
+const (
+	// advisoryContext is the named context that provides the advisory
+	// database, as *.json files in its root.
+	advisoryContext = "apt-advisories"
+
+	// showPath is where `apt-cache show` is stored for the resolved packages
+	// in the temporary image, to find their source packages.
+	showPath = "/btidor.syntax/show"
+
+	// readChunkSize keeps reads of large databases under the gateway's
+	// message size limit.
+	readChunkSize = 8 << 20
+)
+
+// advisorySeverity orders the severities of advisories. Unknown sorts first,
+// so that it never meets a threshold.
+type advisorySeverity int
+
+const (
+	severityUnknown advisorySeverity = iota
+	severityNegligible
+	severityLow
+	severityMedium
+	severityHigh
+	severityCritical
+)
+
+var severityNames = []string{"unknown", "negligible", "low", "medium", "high", "critical"}
+
+func (s advisorySeverity) String() string {
+	return severityNames[s]
+}
+
+// parseSeverity parses a severity word, as used by Debian (urgency),
+// Ubuntu, and GitHub advisories. Debian's "**" markers are ignored.
+func parseSeverity(s string) advisorySeverity {
+	switch strings.TrimRight(strings.ToLower(strings.TrimSpace(s)), "*") {
+	case "negligible", "unimportant", "none":
+		return severityNegligible
+	case "low":
+		return severityLow
+	case "medium", "moderate":
+		return severityMedium
+	case "high", "important":
+		return severityHigh
+	case "critical":
+		return severityCritical
+	default:
+		return severityUnknown
+	}
+}
+
+// cvss3Severity returns the severity rating of a CVSS v3 vector's base
+// score, e.g. "CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H" is critical.
+func cvss3Severity(vector string) advisorySeverity {
+	var weights = map[string]float64{
+		"AV:N": 0.85, "AV:A": 0.62, "AV:L": 0.55, "AV:P": 0.2,
+		"AC:L": 0.77, "AC:H": 0.44,
+		"PR:N": 0.85, "PR:L": 0.62, "PR:H": 0.27,
+		"UI:N": 0.85, "UI:R": 0.62,
+		"C:H": 0.56, "C:L": 0.22, "C:N": 0,
+		"I:H": 0.56, "I:L": 0.22, "I:N": 0,
+		"A:H": 0.56, "A:L": 0.22, "A:N": 0,
+	}
+	var metrics = make(map[string]string)
+	for _, part := range strings.Split(vector, "/") {
+		if name, value, ok := strings.Cut(part, ":"); ok {
+			metrics[name] = name + ":" + value
+		}
+	}
+	var changed = metrics["S"] == "S:C"
+	if changed {
+		weights["PR:L"], weights["PR:H"] = 0.68, 0.5
+	}
+	var w = make(map[string]float64)
+	for _, name := range []string{"AV", "AC", "PR", "UI", "C", "I", "A"} {
+		weight, ok := weights[metrics[name]]
+		if !ok {
+			return severityUnknown
+		}
+		w[name] = weight
+	}
+	var iss = 1 - (1-w["C"])*(1-w["I"])*(1-w["A"])
+	var impact = 6.42 * iss
+	if changed {
+		impact = 7.52*(iss-0.029) - 3.25*math.Pow(iss-0.02, 15)
+	}
+	var exploitability = 8.22 * w["AV"] * w["AC"] * w["PR"] * w["UI"]
+	var score float64
+	switch {
+	case impact <= 0:
+		score = 0
+	case changed:
+		score = cvssRoundUp(min(1.08*(impact+exploitability), 10))
+	default:
+		score = cvssRoundUp(min(impact+exploitability, 10))
+	}
+	switch {
+	case score == 0:
+		return severityNegligible
+	case score < 4:
+		return severityLow
+	case score < 7:
+		return severityMedium
+	case score < 9:
+		return severityHigh
+	default:
+		return severityCritical
+	}
+}
+
+// cvssRoundUp rounds up to one decimal place, working in integers as the
+// CVSS v3.1 specification does to avoid floating point errors.
+func cvssRoundUp(x float64) float64 {
+	var n = int(math.Round(x * 100000))
+	if n%10000 == 0 {
+		return float64(n) / 100000
+	}
+	return (math.Floor(float64(n)/10000) + 1) / 10
+}
+
+// versionEvent is an OSV range event: "introduced", "fixed" or
+// "last_affected", and the version it happens at.
+type versionEvent struct {
+	kind, version string
+}
+
+// advisory is a vulnerability in one source package in one distribution
+// release.
+type advisory struct {
+	ids      []string // the advisory's ID first, then its aliases
+	severity advisorySeverity
+	distro   string // os-release ID, e.g. "debian"
+	release  string // codename or version ID; empty for every release
+	versions []string
+	events   []versionEvent
+}
+
+// matches reports whether the advisory applies to the distribution release
+// described by an os-release file.
+func (a advisory) matches(osRelease map[string]string) bool {
+	return a.distro == osRelease["ID"] && (a.release == "" ||
+		a.release == osRelease["VERSION_CODENAME"] || a.release == osRelease["VERSION_ID"])
+}
+
+// sortedEvents returns the range events sorted by version, as OSV requires
+// before they're evaluated. The "0" that introduces a range from the
+// beginning sorts first.
+func (a advisory) sortedEvents() []versionEvent {
+	return slices.SortedStableFunc(slices.Values(a.events), func(x, y versionEvent) int {
+		switch {
+		case x.version == y.version:
+			return 0
+		case x.version == "0":
+			return -1
+		case y.version == "0":
+			return 1
+		}
+		return compareDebianVersions(x.version, y.version)
+	})
+}
+
+// affects reports whether a version of the source package is vulnerable,
+// evaluating the range events in version order.
+func (a advisory) affects(version string) bool {
+	if slices.Contains(a.versions, version) {
+		return true
+	}
+	var affected bool
+	for _, e := range a.sortedEvents() {
+		switch e.kind {
+		case "introduced":
+			affected = affected || e.version == "0" || compareDebianVersions(version, e.version) >= 0
+		case "fixed":
+			affected = affected && compareDebianVersions(version, e.version) < 0
+		case "last_affected":
+			affected = affected && compareDebianVersions(version, e.version) <= 0
+		}
+	}
+	return affected
+}
+
+// fixedVersion returns the version that fixes the advisory, if any.
+func (a advisory) fixedVersion() string {
+	for _, e := range slices.Backward(a.sortedEvents()) {
+		if e.kind == "fixed" {
+			return e.version
+		}
+	}
+	return ""
+}
+
+// advisoryDatabase holds advisories by source package name.
+type advisoryDatabase map[string][]advisory
+
+// debianIssue is one package's entry for a CVE in the Debian security
+// tracker's JSON export.
+type debianIssue struct {
+	Releases map[string]struct {
+		Status       string `json:"status"`
+		FixedVersion string `json:"fixed_version"`
+		Urgency      string `json:"urgency"`
+	} `json:"releases"`
+}
+
+type osvSeverity struct {
+	Type  string `json:"type"`
+	Score string `json:"score"`
+}
+
+type osvRecord struct {
+	ID               string        `json:"id"`
+	Aliases          []string      `json:"aliases"`
+	Severity         []osvSeverity `json:"severity"`
+	DatabaseSpecific struct {
+		Severity string `json:"severity"`
+	} `json:"database_specific"`
+	Affected []struct {
+		Package struct {
+			Ecosystem string `json:"ecosystem"`
+			Name      string `json:"name"`
+		} `json:"package"`
+		Severity []osvSeverity `json:"severity"`
+		Ranges   []struct {
+			Type   string              `json:"type"`
+			Events []map[string]string `json:"events"`
+		} `json:"ranges"`
+		Versions          []string `json:"versions"`
+		EcosystemSpecific struct {
+			Urgency string `json:"urgency"`
+		} `json:"ecosystem_specific"`
+	} `json:"affected"`
+}
+
+// add parses a database file and adds its advisories. The file can be the
+// Debian security tracker's JSON export, an OSV record, or a list of OSV
+// records.
+func (db advisoryDatabase) add(data []byte) error {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		var records []osvRecord
+		if err := json.Unmarshal(data, &records); err != nil {
+			return err
+		}
+		db.addOSV(records...)
+		return nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	if _, ok := fields["affected"]; ok {
+		var record osvRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return err
+		}
+		db.addOSV(record)
+		return nil
+	}
+	for pkg, raw := range fields {
+		var issues map[string]debianIssue
+		if err := json.Unmarshal(raw, &issues); err != nil {
+			return errors.Wrapf(err, "invalid entry for package %s", pkg)
+		}
+		db.addDebian(pkg, issues)
+	}
+	return nil
+}
+
+func (db advisoryDatabase) addDebian(pkg string, issues map[string]debianIssue) {
+	for id, issue := range issues {
+		for release, status := range issue.Releases {
+			var events = []versionEvent{{"introduced", "0"}}
+			switch {
+			case status.FixedVersion == "0":
+				continue // never affected
+			case status.Status == "resolved" && status.FixedVersion != "":
+				events = append(events, versionEvent{"fixed", status.FixedVersion})
+			}
+			db[pkg] = append(db[pkg], advisory{
+				ids:      []string{id},
+				severity: parseSeverity(status.Urgency),
+				distro:   "debian",
+				release:  release,
+				events:   events,
+			})
+		}
+	}
+}
+
+func (db advisoryDatabase) addOSV(records ...osvRecord) {
+	for _, record := range records {
+		for _, affected := range record.Affected {
+			// Ecosystems are e.g. "Debian:12" or "Ubuntu:22.04:LTS".
+			var parts = strings.Split(affected.Package.Ecosystem, ":")
+			var a = advisory{
+				ids: append([]string{record.ID}, record.Aliases...),
+				severity: osvRecordSeverity(record.DatabaseSpecific.Severity,
+					affected.EcosystemSpecific.Urgency, slices.Concat(affected.Severity, record.Severity)),
+				distro:   strings.ToLower(parts[0]),
+				versions: affected.Versions,
+			}
+			if len(parts) > 1 {
+				a.release = parts[1]
+			}
+			for _, r := range affected.Ranges {
+				if r.Type != "ECOSYSTEM" {
+					continue
+				}
+				for _, event := range r.Events {
+					for kind, version := range event {
+						a.events = append(a.events, versionEvent{kind, version})
+					}
+				}
+			}
+			db[affected.Package.Name] = append(db[affected.Package.Name], a)
+		}
+	}
+}
+
+// osvRecordSeverity picks the severity of an OSV record: a severity word
+// if there is one, otherwise the rating of its CVSS v3 score.
+func osvRecordSeverity(databaseSpecific, urgency string, severities []osvSeverity) advisorySeverity {
+	for _, word := range []string{databaseSpecific, urgency} {
+		if severity := parseSeverity(word); severity != severityUnknown {
+			return severity
+		}
+	}
+	for _, s := range severities {
+		if s.Type == "Ubuntu" {
+			return parseSeverity(s.Score)
+		}
+	}
+	for _, s := range severities {
+		if s.Type == "CVSS_V3" {
+			return cvss3Severity(s.Score)
+		}
+	}
+	return severityUnknown
+}
+
+// sourcePackage is the source package a binary package was built from.
+type sourcePackage struct {
+	name, version string
+}
+
+// parseSourcePackages maps each "name=version" in the output of `apt-cache
+// show` to its source package.
+func parseSourcePackages(data []byte) map[string]sourcePackage {
+	var sources = make(map[string]sourcePackage)
+	for _, stanza := range strings.Split(string(data), "\n\n") {
+		var fields = parseControlStanza(stanza)
+		if fields["Package"] == "" {
+			continue
+		}
+		var source = sourcePackage{fields["Package"], fields["Version"]}
+		if name, version, ok := strings.Cut(fields["Source"], " "); ok {
+			source = sourcePackage{name, strings.Trim(version, "()")}
+		} else if fields["Source"] != "" {
+			source.name = fields["Source"]
+		}
+		sources[fields["Package"]+"="+fields["Version"]] = source
+	}
+	return sources
+}
+
+// loadAdvisories returns the advisory database, calling load the first time.
+// A nil packageChecks calls load every time.
+func (c *packageChecks) loadAdvisories(load func() (advisoryDatabase, error)) (advisoryDatabase, error) {
+	if c == nil {
+		return load()
+	}
+	c.advisoriesOnce.Do(func() {
+		c.advisories, c.advisoriesErr = load()
+	})
+	return c.advisories, c.advisoriesErr
+}
+
+// LoadAdvisories returns the advisory database from the apt-advisories named
+// context, or nil if there isn't one.
+func (i *PackageInvocation) LoadAdvisories() (advisoryDatabase, error) {
+	if i.dopt.dockerClient == nil {
+		return nil, nil
+	}
+	nc, err := i.dopt.dockerClient.NamedContext(advisoryContext, dockerui.ContextOpt{})
+	if err != nil || nc == nil {
+		return nil, err
+	}
+	st, _, err := nc.Load(i.dopt.context)
+	if err != nil {
+		return nil, err
+	}
+	ref, err := i.Solve(*st)
+	if err != nil {
+		return nil, err
+	}
+	files, err := ref.ReadDir(i.dopt.context, client.ReadDirRequest{Path: "/", IncludePattern: "*.json"})
+	if err != nil {
+		return nil, err
+	}
+	var db = make(advisoryDatabase)
+	for _, file := range files {
+		if os.FileMode(file.Mode).IsDir() {
+			continue
+		}
+		data, err := i.readLargeFile(ref, file.Path, file.Size)
+		if err == nil {
+			err = db.add(data)
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load %s from build context %s", file.Path, advisoryContext)
+		}
+	}
+	return db, nil
+}
+
+// readLargeFile reads a file in chunks, since it may not fit in a single
+// message.
+func (i *PackageInvocation) readLargeFile(ref client.Reference, name string, size int64) ([]byte, error) {
+	var data = make([]byte, 0, size)
+	for int64(len(data)) < size {
+		chunk, err := ref.ReadFile(i.dopt.context, client.ReadRequest{
+			Filename: name,
+			Range:    &client.FileRange{Offset: len(data), Length: readChunkSize},
+		})
+		if err != nil || len(chunk) == 0 {
+			return data, err
+		}
+		data = append(data, chunk...)
+	}
+	return data, nil
+}
+
+// showScript prints the package records of the packages that apt resolved,
+// using the names in their archive filenames.
+func (i *PackageInvocation) showScript() string {
+	return fmt.Sprintf("cut -d ' ' -f 2 /btidor.syntax/install | cut -d _ -f 1 | "+
+		"xargs -r apt-cache %s show > %s", i.listsOptions(), showPath)
+}
+
+// advisoryThreshold returns the severity at which advisories fail the build,
+// from BUILDKIT_APT_ADVISORY_SEVERITY. It defaults to high.
+func (i *PackageInvocation) advisoryThreshold() (advisorySeverity, error) {
+	var value = i.dopt.buildArgValues[aptAdvisorySeverity]
+	if value == "" {
+		return severityHigh, nil
+	}
+	var severity = parseSeverity(value)
+	if severity == severityUnknown {
+		return 0, errors.Errorf("invalid value for %s: %s (expected one of %s)",
+			aptAdvisorySeverity, value, strings.Join(severityNames[1:], ", "))
+	}
+	return severity, nil
+}
+
+// ignoredAdvisories returns the advisory IDs listed in
+// BUILDKIT_APT_ADVISORY_IGNORE.
+func (i *PackageInvocation) ignoredAdvisories() map[string]bool {
+	var ignored = make(map[string]bool)
+	for _, id := range strings.Split(i.dopt.buildArgValues[aptAdvisoryIgnore], ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ignored[id] = true
+		}
+	}
+	return ignored
+}
+
+// CheckAdvisories compares the packages to be downloaded and the .deb files
+// named by the command against the advisory database. Packages with
+// advisories at or above the threshold fail the build; those with lesser
+// advisories (other than negligible ones) are reported as warnings. Each is
+// located at the package's name, if the command names it.
+func (i *PackageInvocation) CheckAdvisories(db advisoryDatabase, files []PackageDownload,
+	sources map[string]sourcePackage, osRelease map[string]string) error {
+
+	threshold, err := i.advisoryThreshold()
+	if err != nil {
+		return parser.WithLocation(err, i.cmd.Location())
+	}
+	var ignored = i.ignoredAdvisories()
+	var failures []string
+	var location []parser.Range
+	for _, file := range i.checkedPackages(files) {
+		if !strings.HasSuffix(file.filename, ".deb") {
+			continue
+		}
+		var name, version = file.name, file.version
+		var pkg = fmt.Sprintf("%s %s", name, version)
+		var source, ok = sources[name+"="+version]
+		if !ok {
+			source = sourcePackage{name, version}
+		} else if source.name != name {
+			pkg += fmt.Sprintf(" (source %s)", source.name)
+		}
+		var failing, warning []string
+		for _, a := range db[source.name] {
+			if !a.matches(osRelease) || !a.affects(source.version) ||
+				slices.ContainsFunc(a.ids, func(id string) bool { return ignored[id] }) {
+				continue
+			}
+			var finding = fmt.Sprintf("%s (%s", a.ids[0], a.severity)
+			if fixed := a.fixedVersion(); fixed != "" {
+				finding += ", fixed in " + fixed
+			}
+			finding += ")"
+			switch {
+			case a.severity >= threshold:
+				failing = append(failing, finding)
+			case a.severity != severityNegligible:
+				warning = append(warning, finding)
+			}
+		}
+		slices.Sort(failing)
+		slices.Sort(warning)
+		if len(warning) > 0 {
+			i.dopt.lint.Run(&linter.RuleAptPackageAdvisory, i.packageLocation(name),
+				linter.RuleAptPackageAdvisory.Format(pkg, strings.Join(warning, ", ")))
+		}
+		if len(failing) > 0 {
+			failures = append(failures, fmt.Sprintf("%s is affected by %s", pkg, strings.Join(failing, ", ")))
+			if location == nil {
+				location = i.packageLocation(name)
+			}
+		}
+	}
+	if len(failures) == 0 {
+		return nil
+	}
+	err = errors.Errorf("packages have advisories at or above %s severity: %s; "+
+		"list accepted advisories in %s to proceed", threshold, strings.Join(failures, "; "), aptAdvisoryIgnore)
+	return parser.WithLocation(err, location)
+}
@@ -0,0 +1,195 @@
+package dockerfile2llb
+
+import (
+	"testing"
+
+	"github.com/btidor/syntax/dockerfile/instructions"
+	"github.com/btidor/syntax/dockerfile/linter"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdvisorySeverity(t *testing.T) {
+	t.Parallel()
+	require.Equal(t, severityNegligible, parseSeverity("unimportant"))
+	require.Equal(t, severityMedium, parseSeverity("Moderate"))
+	require.Equal(t, severityHigh, parseSeverity("high**"))
+	require.Equal(t, severityUnknown, parseSeverity("not yet assigned"))
+
+	require.Equal(t, severityCritical, cvss3Severity("CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H"))
+	require.Equal(t, severityHigh, cvss3Severity("CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:N/I:N/A:H"))
+	require.Equal(t, severityMedium, cvss3Severity("CVSS:3.1/AV:N/AC:L/PR:N/UI:R/S:C/C:L/I:L/A:N"))
+	require.Equal(t, severityLow, cvss3Severity("CVSS:3.1/AV:L/AC:H/PR:L/UI:N/S:U/C:L/I:N/A:N"))
+	require.Equal(t, severityNegligible, cvss3Severity("CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:N/I:N/A:N"))
+	require.Equal(t, severityUnknown, cvss3Severity("CVSS:3.1/AV:N"))
+}
+
+func TestAdvisoryAffects(t *testing.T) {
+	t.Parallel()
+	var a = advisory{events: []versionEvent{{"introduced", "0"}, {"fixed", "3.0.13-1~deb12u1"}}}
+	require.True(t, a.affects("3.0.11-1~deb12u2"))
+	require.False(t, a.affects("3.0.13-1~deb12u1"))
+	require.Equal(t, "3.0.13-1~deb12u1", a.fixedVersion())
+
+	a = advisory{events: []versionEvent{{"introduced", "1.2-1"}, {"last_affected", "1.4-2"}}, versions: []string{"1.0-1"}}
+	require.True(t, a.affects("1.0-1"))
+	require.False(t, a.affects("1.1-1"))
+	require.True(t, a.affects("1.4-2"))
+	require.False(t, a.affects("1.4-3"))
+	require.Equal(t, "", a.fixedVersion())
+
+	// Events are evaluated in version order, whatever order they're listed in.
+	a = advisory{events: []versionEvent{{"fixed", "2.0-1"}, {"introduced", "1.5-1"}, {"fixed", "1.2-1"}, {"introduced", "0"}}}
+	require.True(t, a.affects("1.0-1"))
+	require.False(t, a.affects("1.3-1"))
+	require.True(t, a.affects("1.6-1"))
+	require.False(t, a.affects("2.0-1"))
+	require.Equal(t, "2.0-1", a.fixedVersion())
+}
+
+func TestAdvisoryDatabase(t *testing.T) {
+	t.Parallel()
+	var db = make(advisoryDatabase)
+	require.NoError(t, db.add([]byte(`{
+		"openssl": {
+			"CVE-2024-0727": {"releases": {
+				"bookworm": {"status": "resolved", "fixed_version": "3.0.13-1~deb12u1", "urgency": "high"},
+				"trixie": {"status": "resolved", "fixed_version": "0", "urgency": "not yet assigned"}
+			}}
+		}
+	}`)))
+	require.NoError(t, db.add([]byte(`{
+		"id": "DSA-5600-1",
+		"aliases": ["CVE-2024-0001"],
+		"severity": [{"type": "CVSS_V3", "score": "CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H"}],
+		"affected": [{
+			"package": {"ecosystem": "Debian:12", "name": "openssl"},
+			"ranges": [{"type": "ECOSYSTEM", "events": [{"introduced": "0"}, {"fixed": "3.0.14-1"}]}]
+		}]
+	}`)))
+	require.NoError(t, db.add([]byte(`[{"id": "USN-1", "affected": [{"package": {"ecosystem": "Ubuntu:22.04:LTS", "name": "curl"}}]}]`)))
+	require.Error(t, db.add([]byte(`{"openssl": []}`)))
+
+	require.Equal(t, advisoryDatabase{
+		"openssl": {{
+			ids:      []string{"CVE-2024-0727"},
+			severity: severityHigh,
+			distro:   "debian",
+			release:  "bookworm",
+			events:   []versionEvent{{"introduced", "0"}, {"fixed", "3.0.13-1~deb12u1"}},
+		}, {
+			ids:      []string{"DSA-5600-1", "CVE-2024-0001"},
+			severity: severityCritical,
+			distro:   "debian",
+			release:  "12",
+			events:   []versionEvent{{"introduced", "0"}, {"fixed", "3.0.14-1"}},
+		}},
+		"curl": {{ids: []string{"USN-1"}, distro: "ubuntu", release: "22.04"}},
+	}, db)
+
+	var bookworm = map[string]string{"ID": "debian", "VERSION_ID": "12", "VERSION_CODENAME": "bookworm"}
+	require.True(t, db["openssl"][0].matches(bookworm))
+	require.True(t, db["openssl"][1].matches(bookworm))
+	require.False(t, db["curl"][0].matches(bookworm))
+}
+
+func TestLoadAdvisoriesOnce(t *testing.T) {
+	t.Parallel()
+	var loads int
+	var load = func() (advisoryDatabase, error) {
+		loads++
+		return advisoryDatabase{"openssl": nil}, nil
+	}
+	var checks = &packageChecks{}
+	for range 2 {
+		db, err := checks.loadAdvisories(load)
+		require.NoError(t, err)
+		require.Contains(t, db, "openssl")
+	}
+	require.Equal(t, 1, loads)
+}
+
+func TestParseSourcePackages(t *testing.T) {
+	t.Parallel()
+	var data = []byte(`Package: libssl3
+Version: 3.0.11-1~deb12u2
+Source: openssl
+Description: Secure Sockets Layer toolkit
+ This package is part of the OpenSSL project.
+
+Package: libc6
+Version: 2.36-9+deb12u4+b1
+Source: glibc (2.36-9+deb12u4)
+
+Package: sl
+Version: 5.02-1
+`)
+	require.Equal(t, map[string]sourcePackage{
+		"libssl3=3.0.11-1~deb12u2": {"openssl", "3.0.11-1~deb12u2"},
+		"libc6=2.36-9+deb12u4+b1":  {"glibc", "2.36-9+deb12u4"},
+		"sl=5.02-1":                {"sl", "5.02-1"},
+	}, parseSourcePackages(data))
+}
+
+func TestCheckAdvisories(t *testing.T) {
+	t.Parallel()
+	var warnings []string
+	var i = &PackageInvocation{
+		d:   &dispatchState{},
+		cmd: &instructions.PackageCommand{PackageNames: []string{"curl"}},
+		dopt: dispatchOpt{lint: linter.New(&linter.Config{
+			Warn: func(rulename, description, url, fmtmsg string, location []parser.Range) {
+				warnings = append(warnings, fmtmsg)
+			},
+		})},
+	}
+	var db = advisoryDatabase{
+		"openssl": {
+			{ids: []string{"CVE-2024-0727"}, severity: severityHigh, distro: "debian", release: "bookworm",
+				events: []versionEvent{{"introduced", "0"}, {"fixed", "3.0.13-1~deb12u1"}}},
+			{ids: []string{"CVE-2023-0001"}, severity: severityLow, distro: "debian",
+				events: []versionEvent{{"introduced", "0"}}},
+			{ids: []string{"CVE-2023-0002"}, severity: severityNegligible, distro: "debian",
+				events: []versionEvent{{"introduced", "0"}}},
+		},
+	}
+	var files = []PackageDownload{
+		{filename: "curl_7.88.1-10+deb12u5_amd64.deb"},
+		{filename: "libssl3_3.0.11-1~deb12u2_amd64.deb"},
+	}
+	var sources = map[string]sourcePackage{
+		"libssl3=3.0.11-1~deb12u2": {"openssl", "3.0.11-1~deb12u2"},
+	}
+	var bookworm = map[string]string{"ID": "debian", "VERSION_ID": "12", "VERSION_CODENAME": "bookworm"}
+
+	var err = i.CheckAdvisories(db, files, sources, bookworm)
+	require.EqualError(t, err, "packages have advisories at or above high severity: "+
+		"libssl3 3.0.11-1~deb12u2 (source openssl) is affected by CVE-2024-0727 (high, fixed in 3.0.13-1~deb12u1); "+
+		"list accepted advisories in BUILDKIT_APT_ADVISORY_IGNORE to proceed")
+	require.Equal(t, []string{"Package libssl3 3.0.11-1~deb12u2 (source openssl) is affected by CVE-2023-0001 (low)"}, warnings)
+
+	i.dopt.buildArgValues = map[string]string{aptAdvisoryIgnore: "CVE-2024-0727"}
+	require.NoError(t, i.CheckAdvisories(db, files, sources, bookworm))
+
+	i.dopt.buildArgValues = map[string]string{aptAdvisorySeverity: "critical"}
+	require.NoError(t, i.CheckAdvisories(db, files, sources, bookworm))
+
+	i.dopt.buildArgValues = map[string]string{aptAdvisorySeverity: "low"}
+	require.ErrorContains(t, i.CheckAdvisories(db, files, sources, bookworm),
+		"is affected by CVE-2023-0001 (low), CVE-2024-0727 (high, fixed in 3.0.13-1~deb12u1)")
+
+	i.dopt.buildArgValues = map[string]string{aptAdvisorySeverity: "severe"}
+	require.ErrorContains(t, i.CheckAdvisories(db, files, sources, bookworm),
+		"invalid value for BUILDKIT_APT_ADVISORY_SEVERITY: severe (expected one of negligible, low, medium, high, critical)")
+
+	i.dopt.buildArgValues = nil
+	require.NoError(t, i.CheckAdvisories(db, files, sources, map[string]string{"ID": "ubuntu"}))
+
+	// .deb files named by the command are checked by their package names.
+	i.cmd.PackageNames = []string{"./vendor.deb"}
+	i.packageFiles = map[int]packageRecord{
+		0: {PackageDownload: PackageDownload{filename: "vendor.deb"}, name: "libssl3", version: "3.0.11-1~deb12u2"},
+	}
+	require.ErrorContains(t, i.CheckAdvisories(db, nil, sources, bookworm),
+		"libssl3 3.0.11-1~deb12u2 (source openssl) is affected by CVE-2024-0727")
+}
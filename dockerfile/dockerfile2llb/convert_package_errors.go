@@ -0,0 +1,95 @@
+package dockerfile2llb
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/moby/buildkit/frontend/gateway/client"
+	"github.com/moby/buildkit/util/suggest"
+	"github.com/pkg/errors"
+)
+
+const (
+	// resolveErrorsPath is where apt's stderr from the resolve step is stored
+	// in the temporary image.
+	resolveErrorsPath = "/btidor.syntax/errors"
+
+	// pkgnamesPath lists the known package names. It's only written when
+	// resolution fails, and its presence marks the failure.
+	pkgnamesPath = "/btidor.syntax/pkgnames"
+)
+
+var unknownPackageRegex = regexp.MustCompile(`^E: Unable to locate package (\S+)`)
+
+// ResolveError returns a located error if apt failed to resolve the packages
+// in the resolve step, or nil if it succeeded.
+func (i *PackageInvocation) ResolveError(ref client.Reference) error {
+	if _, err := ref.StatFile(i.dopt.context, client.StatRequest{Path: pkgnamesPath}); err != nil {
+		return nil
+	}
+	data, err := i.ReadFile(ref, resolveErrorsPath)
+	if err != nil {
+		return err
+	}
+	var messages []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if match := unknownPackageRegex.FindStringSubmatch(line); match != nil {
+			names, err := i.ReadFile(ref, pkgnamesPath)
+			if err != nil {
+				return err
+			}
+			return i.unknownPackageError(match[1], strings.Fields(string(names)))
+		}
+		if msg, ok := strings.CutPrefix(line, "E: "); ok {
+			messages = append(messages, msg)
+		}
+	}
+	if len(messages) == 0 {
+		messages = append(messages, "apt-get exited with an error")
+	}
+	err = errors.Errorf("failed to resolve packages: %s", strings.Join(messages, "; "))
+	return parser.WithLocation(err, i.cmd.Location())
+}
+
+// unknownPackageError reports a package that apt couldn't find, pointing at
+// its name in the Dockerfile and suggesting similar package names.
+func (i *PackageInvocation) unknownPackageError(name string, known []string) error {
+	var err = errors.Errorf("unable to locate package %q", name)
+	err = suggest.WrapError(err, name, known, true)
+	return parser.WithLocation(err, i.packageLocation(name))
+}
+
+// packageLocation returns the location of a package's name in the command,
+// see packageTokenLocation.
+func (i *PackageInvocation) packageLocation(name string) []parser.Range {
+	var source []byte
+	if i.dopt.sourceMap != nil {
+		source = i.dopt.sourceMap.Data
+	}
+	return packageTokenLocation(source, i.cmd.Location(), name)
+}
+
+// packageTokenLocation finds the word that names a package in the lines of
+// the Dockerfile covered by location. The word may carry a version, release or
+// architecture qualifier. If it can't be found, the whole location is
+// returned.
+func packageTokenLocation(source []byte, location []parser.Range, name string) []parser.Range {
+	if len(location) == 0 {
+		return location
+	}
+	var tokenRegex = regexp.MustCompile(`(^|\s)(` + regexp.QuoteMeta(name) + `([=/:]\S*)?)(\s|$)`)
+	var lines = strings.Split(string(source), "\n")
+	for n := location[0].Start.Line; n <= location[len(location)-1].End.Line; n++ {
+		if n < 1 || n > len(lines) {
+			break
+		}
+		if match := tokenRegex.FindStringSubmatchIndex(lines[n-1]); match != nil {
+			return []parser.Range{{
+				Start: parser.Position{Line: n, Character: match[4]},
+				End:   parser.Position{Line: n, Character: match[5]},
+			}}
+		}
+	}
+	return location
+}
@@ -0,0 +1,48 @@
+package dockerfile2llb
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/btidor/syntax/dockerfile/instructions"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPackageTokenLocation(t *testing.T) {
+	t.Parallel()
+	var source = []byte("FROM debian\nADD --apt --group=nginxx \\\n    curl nginxx=1.2 \\\n    git\n")
+	var location = []parser.Range{{Start: parser.Position{Line: 2}, End: parser.Position{Line: 4}}}
+
+	require.Equal(t, []parser.Range{{
+		Start: parser.Position{Line: 3, Character: 9},
+		End:   parser.Position{Line: 3, Character: 19},
+	}}, packageTokenLocation(source, location, "nginxx"))
+	require.Equal(t, []parser.Range{{
+		Start: parser.Position{Line: 4, Character: 4},
+		End:   parser.Position{Line: 4, Character: 7},
+	}}, packageTokenLocation(source, location, "git"))
+	require.Equal(t, location, packageTokenLocation(source, location, "vim"))
+}
+
+func TestUnknownPackageError(t *testing.T) {
+	t.Parallel()
+	var source = []byte("FROM debian\nADD --apt curl nginxx\n")
+	ast, err := parser.Parse(bytes.NewReader(source))
+	require.NoError(t, err)
+	cmd, err := instructions.ParseInstruction(ast.AST.Children[1])
+	require.NoError(t, err)
+	var i = NewPackageInvocation(&dispatchState{}, cmd.(*instructions.PackageCommand), nil, dispatchOpt{
+		sourceMap: llb.NewSourceMap(nil, "Dockerfile", "", source),
+	})
+	err = i.unknownPackageError("nginxx", []string{"curl", "nginx", "nginx-common"})
+	require.ErrorContains(t, err, `unable to locate package "nginxx" (did you mean nginx?)`)
+
+	var el *parser.LocationError
+	require.ErrorAs(t, err, &el)
+	require.Equal(t, []parser.Range{{
+		Start: parser.Position{Line: 2, Character: 15},
+		End:   parser.Position{Line: 2, Character: 21},
+	}}, el.Locations[0])
+}
@@ -0,0 +1,195 @@
+package dockerfile2llb
+
+import (
+	"cmp"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/pkg/errors"
+)
+
+// planPath is where the output of `apt-get install --simulate` is stored in
+// the temporary image.
+const planPath = "/btidor.syntax/plan"
+
+// packageChange is a change to an installed package in apt's plan.
+type packageChange struct {
+	name     string
+	from, to string // versions; `to` is empty for removals
+}
+
+func (c packageChange) String() string {
+	if c.to == "" {
+		return fmt.Sprintf("%s (%s)", c.name, c.from)
+	}
+	return fmt.Sprintf("%s (%s -> %s)", c.name, c.from, c.to)
+}
+
+var (
+	planInstRegex   = regexp.MustCompile(`^Inst (\S+) (?:\[(\S+)\] )?\((\S+) `)
+	planRemoveRegex = regexp.MustCompile(`^(?:Remv|Purg) (\S+)(?: \[(\S+)\])?`)
+)
+
+// parsePackagePlan finds the packages that apt plans to remove or downgrade in
+// the output of `apt-get install --simulate`.
+func parsePackagePlan(data []byte) (removed, downgraded []packageChange) {
+	for _, line := range strings.Split(string(data), "\n") {
+		if match := planRemoveRegex.FindStringSubmatch(line); match != nil {
+			removed = append(removed, packageChange{name: match[1], from: match[2]})
+		} else if match := planInstRegex.FindStringSubmatch(line); match != nil && match[2] != "" {
+			if compareDebianVersions(match[3], match[2]) < 0 {
+				downgraded = append(downgraded, packageChange{match[1], match[2], match[3]})
+			}
+		}
+	}
+	return removed, downgraded
+}
+
+// parseNewPackages finds the packages that apt plans to install that aren't
+// installed yet, in the output of `apt-get install --simulate`. Upgrades of
+// installed packages aren't included.
+func parseNewPackages(data []byte) []string {
+	var names []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if match := planInstRegex.FindStringSubmatch(line); match != nil && match[2] == "" {
+			names = append(names, match[1])
+		}
+	}
+	return names
+}
+
+// CheckPlan fails the build if apt plans to remove or downgrade installed
+// packages, unless the command allows it.
+func (i *PackageInvocation) CheckPlan(data []byte) error {
+	var removed, downgraded = parsePackagePlan(data)
+	for _, check := range []struct {
+		changes []packageChange
+		allowed bool
+		verb    string
+		flag    string
+	}{
+		{removed, i.cmd.AllowRemove, "remove", "allow-remove"},
+		{downgraded, i.cmd.AllowDowngrade, "downgrade", "allow-downgrade"},
+	} {
+		if len(check.changes) == 0 || check.allowed {
+			continue
+		}
+		var names []string
+		for _, c := range check.changes {
+			names = append(names, c.String())
+		}
+		var err = errors.Errorf("%s would %s %s; pass --%s if this is intended",
+			i.describeAction(), check.verb, strings.Join(names, ", "), check.flag)
+		return parser.WithLocation(err, i.cmd.Location())
+	}
+	return nil
+}
+
+// describeAction describes what the command asks apt to do, for error
+// messages.
+func (i *PackageInvocation) describeAction() string {
+	var names = strings.Join(i.cmd.PackageNames, " ")
+	switch {
+	case i.cmd.BuildDep:
+		return "installing the build dependencies of " + names
+	case !i.cmd.Upgrade:
+		return "installing " + names
+	case names == "":
+		return "upgrading"
+	default:
+		return "upgrading and installing " + names
+	}
+}
+
+// allowOptions returns the apt-get options that let the install step make the
+// changes allowed by the command.
+func (i *PackageInvocation) allowOptions() string {
+	var opts string
+	if i.cmd.AllowRemove {
+		opts += " --allow-remove-essential"
+	}
+	if i.cmd.AllowDowngrade {
+		opts += " --allow-downgrades"
+	}
+	return opts
+}
+
+// compareDebianVersions compares two Debian package versions the way dpkg
+// does, returning -1, 0 or 1.
+func compareDebianVersions(a, b string) int {
+	var epochA, upstreamA, revisionA = splitDebianVersion(a)
+	var epochB, upstreamB, revisionB = splitDebianVersion(b)
+	if c := cmp.Compare(epochA, epochB); c != 0 {
+		return c
+	}
+	if c := compareVersionPart(upstreamA, upstreamB); c != 0 {
+		return c
+	}
+	return compareVersionPart(revisionA, revisionB)
+}
+
+// splitDebianVersion splits a version into its epoch, upstream version and
+// Debian revision.
+func splitDebianVersion(v string) (epoch int, upstream, revision string) {
+	if e, rest, ok := strings.Cut(v, ":"); ok {
+		epoch, _ = strconv.Atoi(e)
+		v = rest
+	}
+	if n := strings.LastIndexByte(v, '-'); n >= 0 {
+		return epoch, v[:n], v[n+1:]
+	}
+	return epoch, v, ""
+}
+
+// compareVersionPart compares alternating runs of non-digits and digits. In
+// non-digit runs, `~` sorts before everything (even the end of the string)
+// and letters sort before other characters.
+func compareVersionPart(a, b string) int {
+	for a != "" || b != "" {
+		for (a != "" && !isDigit(a[0])) || (b != "" && !isDigit(b[0])) {
+			var orderA, orderB = versionCharOrder(a), versionCharOrder(b)
+			if orderA != orderB {
+				return cmp.Compare(orderA, orderB)
+			}
+			a, b = a[1:], b[1:]
+		}
+		a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+		var digitsA, digitsB = leadingDigits(a), leadingDigits(b)
+		if c := cmp.Compare(len(digitsA), len(digitsB)); c != 0 {
+			return c
+		}
+		if c := strings.Compare(digitsA, digitsB); c != 0 {
+			return c
+		}
+		a, b = a[len(digitsA):], b[len(digitsB):]
+	}
+	return 0
+}
+
+func versionCharOrder(s string) int {
+	switch {
+	case s == "" || isDigit(s[0]):
+		return 0
+	case s[0] == '~':
+		return -1
+	case ('a' <= s[0] && s[0] <= 'z') || ('A' <= s[0] && s[0] <= 'Z'):
+		return int(s[0])
+	default:
+		return int(s[0]) + 256
+	}
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func leadingDigits(s string) string {
+	var n = 0
+	for n < len(s) && isDigit(s[n]) {
+		n++
+	}
+	return s[:n]
+}
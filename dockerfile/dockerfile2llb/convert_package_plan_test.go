@@ -0,0 +1,71 @@
+package dockerfile2llb
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/btidor/syntax/dockerfile/instructions"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompareDebianVersions(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0", "1.00", 0},
+		{"1.0", "1.1", -1},
+		{"1.10", "1.9", 1},
+		{"1.0~rc1", "1.0", -1},
+		{"1.0", "1.0+deb12u1", -1},
+		{"1.0a", "1.0+", -1},
+		{"2.36-9+deb12u4", "2.36-9", 1},
+		{"1:1.0", "2.0", 1},
+		{"1.0-1", "1.0-1~bpo12+1", 1},
+		{"7.88.1-10+deb12u5", "7.88.1-10+deb12u12", -1},
+	} {
+		require.Equal(t, tc.want, compareDebianVersions(tc.a, tc.b), "%s vs %s", tc.a, tc.b)
+		require.Equal(t, -tc.want, compareDebianVersions(tc.b, tc.a), "%s vs %s", tc.b, tc.a)
+	}
+}
+
+func TestCheckPlan(t *testing.T) {
+	t.Parallel()
+	var plan = []byte(`NOTE: This is only a simulation!
+Reading package lists...
+Remv libfoo1 [1.2-1]
+Inst libc6 [2.36-9+deb12u4] (2.36-9 Debian:12.0/stable [amd64])
+Inst libssl3 [3.0.11-1~deb12u1] (3.0.13-1~deb12u1 Debian-Security:12/stable-security [amd64])
+Inst sl (5.02-1 Debian:12/stable [amd64])
+Conf libc6 (2.36-9 Debian:12.0/stable [amd64])
+`)
+	removed, downgraded := parsePackagePlan(plan)
+	require.Equal(t, []packageChange{{name: "libfoo1", from: "1.2-1"}}, removed)
+	require.Equal(t, []packageChange{{"libc6", "2.36-9+deb12u4", "2.36-9"}}, downgraded)
+	require.Equal(t, []string{"sl"}, parseNewPackages(plan))
+
+	ast, err := parser.Parse(bytes.NewBufferString("FROM debian\n\nADD --apt sl\n"))
+	require.NoError(t, err)
+	parsed, err := instructions.ParseInstruction(ast.AST.Children[1])
+	require.NoError(t, err)
+	var cmd = parsed.(*instructions.PackageCommand)
+	var i = &PackageInvocation{cmd: cmd}
+	err = i.CheckPlan(plan)
+	require.ErrorContains(t, err, "installing sl would remove libfoo1 (1.2-1); pass --allow-remove if this is intended")
+	var el *parser.LocationError
+	require.ErrorAs(t, err, &el)
+	require.Equal(t, 3, el.Locations[0][0].Start.Line)
+
+	cmd.AllowRemove = true
+	require.ErrorContains(t, i.CheckPlan(plan), "would downgrade libc6 (2.36-9+deb12u4 -> 2.36-9)")
+	require.Equal(t, " --allow-remove-essential", i.allowOptions())
+
+	cmd.Upgrade = true
+	require.ErrorContains(t, i.CheckPlan(plan), "upgrading and installing sl would downgrade")
+
+	cmd.AllowDowngrade = true
+	require.NoError(t, i.CheckPlan(plan))
+}
@@ -0,0 +1,257 @@
+package dockerfile2llb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/moby/buildkit/frontend/dockerui"
+	"github.com/pkg/errors"
+)
+
+const (
+	// policyContext is the named context that can provide the package policy
+	// as policyFile, instead of BUILDKIT_APT_POLICY.
+	policyContext = "apt-policy"
+	policyFile    = "policy.json"
+
+	// dependsPath is where the dependencies of the resolved packages are
+	// stored in the temporary image, to explain policy violations.
+	dependsPath = "/btidor.syntax/depends"
+)
+
+// packagePolicy restricts what `ADD --apt` may download. Package names and
+// hosts are matched as globs, e.g. "rsh-*" or "*.debian.org".
+type packagePolicy struct {
+	Deny         []string `json:"deny"`         // packages that are forbidden
+	Allow        []string `json:"allow"`        // if set, the only packages permitted
+	AllowedHosts []string `json:"allowedHosts"` // if set, the only hosts permitted
+	RequireHTTPS bool     `json:"requireHTTPS"`
+}
+
+// parsePackagePolicy parses a policy, rejecting unknown fields and malformed
+// globs so that mistakes don't silently weaken it.
+func parsePackagePolicy(data []byte) (*packagePolicy, error) {
+	var policy packagePolicy
+	var decoder = json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&policy); err != nil {
+		return nil, err
+	}
+	for _, pattern := range slices.Concat(policy.Deny, policy.Allow, policy.AllowedHosts) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid pattern %q", pattern)
+		}
+	}
+	return &policy, nil
+}
+
+// matchesAny reports whether name matches any of the globs.
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// packageChecks holds what `ADD --apt` checks packages against, loaded by
+// the first command that needs it and shared by the rest of the build.
+type packageChecks struct {
+	policyOnce sync.Once
+	policy     *packagePolicy
+	policyErr  error
+
+	advisoriesOnce sync.Once
+	advisories     advisoryDatabase
+	advisoriesErr  error
+}
+
+// loadPolicy returns the package policy, calling load the first time. A nil
+// packageChecks calls load every time.
+func (c *packageChecks) loadPolicy(load func() (*packagePolicy, error)) (*packagePolicy, error) {
+	if c == nil {
+		return load()
+	}
+	c.policyOnce.Do(func() {
+		c.policy, c.policyErr = load()
+	})
+	return c.policy, c.policyErr
+}
+
+// LoadPolicy returns the package policy from BUILDKIT_APT_POLICY or the
+// apt-policy named context, or nil if neither is set.
+func (i *PackageInvocation) LoadPolicy() (*packagePolicy, error) {
+	if value := i.dopt.buildArgValues[aptPolicy]; value != "" {
+		policy, err := parsePackagePolicy([]byte(value))
+		return policy, errors.Wrapf(err, "invalid %s", aptPolicy)
+	}
+	if i.dopt.dockerClient == nil {
+		return nil, nil
+	}
+	nc, err := i.dopt.dockerClient.NamedContext(policyContext, dockerui.ContextOpt{})
+	if err != nil || nc == nil {
+		return nil, err
+	}
+	st, _, err := nc.Load(i.dopt.context)
+	if err != nil {
+		return nil, err
+	}
+	ref, err := i.Solve(*st)
+	if err != nil {
+		return nil, err
+	}
+	data, err := i.ReadFile(ref, policyFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s from build context %s", policyFile, policyContext)
+	}
+	policy, err := parsePackagePolicy(data)
+	return policy, errors.Wrapf(err, "invalid %s in build context %s", policyFile, policyContext)
+}
+
+// dependsScript lists the dependencies of the packages that apt resolved,
+// using the names in their archive filenames.
+func (i *PackageInvocation) dependsScript() string {
+	return fmt.Sprintf("cut -d ' ' -f 2 /btidor.syntax/install | cut -d _ -f 1 | "+
+		"xargs -r apt-cache %s depends --no-suggests --no-conflicts --no-breaks "+
+		"--no-replaces --no-enhances > %s", i.listsOptions(), dependsPath)
+}
+
+var dependsRegex = regexp.MustCompile(`^\s+\|?(?:PreDepends|Depends|Recommends): <?([^\s:>]+)`)
+
+// parseDependencies parses the output of `apt-cache depends` into a map from
+// each package to the packages it depends on. Virtual packages are replaced
+// by their providers.
+func parseDependencies(data []byte) map[string][]string {
+	var deps = make(map[string][]string)
+	var pkg string
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if match := dependsRegex.FindStringSubmatch(line); match != nil {
+			if !strings.Contains(line, "<") {
+				deps[pkg] = append(deps[pkg], match[1])
+			}
+		} else if strings.HasPrefix(line, "    ") {
+			// A provider of the preceding virtual package.
+			var provider, _, _ = strings.Cut(strings.TrimSpace(line), ":")
+			deps[pkg] = append(deps[pkg], provider)
+		} else if !strings.HasPrefix(line, " ") {
+			pkg, _, _ = strings.Cut(strings.TrimSpace(line), ":")
+		}
+	}
+	return deps
+}
+
+// dependencyChain returns the shortest chain of dependencies from one of the
+// requested packages to name, e.g. [curl libcurl4 libldap-2.5-0]. If name
+// can't be reached, the chain is just name.
+func dependencyChain(deps map[string][]string, requested []string, name string) []string {
+	var parent = make(map[string]string)
+	var queue []string
+	for _, root := range requested {
+		if _, ok := parent[root]; !ok {
+			parent[root] = ""
+			queue = append(queue, root)
+		}
+	}
+	for len(queue) > 0 {
+		var pkg = queue[0]
+		queue = queue[1:]
+		if pkg == name {
+			var chain []string
+			for ; pkg != ""; pkg = parent[pkg] {
+				chain = append(chain, pkg)
+			}
+			slices.Reverse(chain)
+			return chain
+		}
+		for _, dep := range deps[pkg] {
+			if _, ok := parent[dep]; !ok {
+				parent[dep] = pkg
+				queue = append(queue, dep)
+			}
+		}
+	}
+	return []string{name}
+}
+
+// requestedPackages returns the names of the packages the command asks for,
+// without version, release or architecture qualifiers. .deb files are named
+// after the package they contain.
+func (i *PackageInvocation) requestedPackages() []string {
+	var names []string
+	for n, name := range i.cmd.PackageNames {
+		if file, ok := i.packageFiles[n]; ok {
+			name = file.name
+		} else if n := strings.IndexAny(name, "=/:"); n >= 0 {
+			name = name[:n]
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// CheckPolicy fails the build if any of the packages to be downloaded or the
+// .deb files named by the command, or the URIs they come from, violate the
+// policy. Each violation names the dependency chain that pulled the package
+// in, and the error points at the package that was asked for.
+func (i *PackageInvocation) CheckPolicy(policy *packagePolicy, files []PackageDownload,
+	deps map[string][]string) error {
+
+	if policy == nil {
+		return nil
+	}
+	var requested = i.requestedPackages()
+	var violations []string
+	var location []parser.Range
+	for _, file := range i.checkedPackages(files) {
+		var name = file.name
+		var problems []string
+		if strings.HasSuffix(file.filename, ".deb") {
+			if matchesAny(policy.Deny, name) {
+				problems = append(problems, "forbids package "+name)
+			} else if len(policy.Allow) > 0 && !matchesAny(policy.Allow, name) {
+				problems = append(problems, "doesn't allow package "+name)
+			}
+		}
+		// .deb files from the build context have no URI, and packages from
+		// the mirror have a file: one; neither has a host to check.
+		if u, err := url.Parse(file.uri); err != nil {
+			problems = append(problems, fmt.Sprintf("can't check %s (%s)", name, file.uri))
+		} else if file.uri != "" && u.Scheme != "file" {
+			if policy.RequireHTTPS && u.Scheme != "https" {
+				problems = append(problems, fmt.Sprintf("requires HTTPS, but %s comes from %s", name, file.uri))
+			}
+			if len(policy.AllowedHosts) > 0 && !matchesAny(policy.AllowedHosts, u.Hostname()) {
+				problems = append(problems, fmt.Sprintf("doesn't allow host %s, where %s comes from", u.Hostname(), name))
+			}
+		}
+		if len(problems) == 0 {
+			continue
+		}
+		var chain = dependencyChain(deps, requested, name)
+		var violation = strings.Join(problems, " and ")
+		if len(chain) > 1 {
+			violation += fmt.Sprintf(" (pulled in by %s)", strings.Join(chain, " -> "))
+		}
+		violations = append(violations, violation)
+		if location == nil {
+			location = i.packageLocation(chain[0])
+		}
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+	var err = errors.Errorf("apt policy %s", strings.Join(violations, "; "))
+	return parser.WithLocation(err, location)
+}
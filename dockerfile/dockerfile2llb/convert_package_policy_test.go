@@ -0,0 +1,134 @@
+package dockerfile2llb
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/btidor/syntax/dockerfile/instructions"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePackagePolicy(t *testing.T) {
+	t.Parallel()
+	policy, err := parsePackagePolicy([]byte(`{"deny": ["telnetd", "rsh-*"], "requireHTTPS": true}`))
+	require.NoError(t, err)
+	require.Equal(t, &packagePolicy{Deny: []string{"telnetd", "rsh-*"}, RequireHTTPS: true}, policy)
+
+	_, err = parsePackagePolicy([]byte(`{"denied": ["telnetd"]}`))
+	require.ErrorContains(t, err, `unknown field "denied"`)
+	_, err = parsePackagePolicy([]byte(`{"allowedHosts": ["[deb.debian.org"]}`))
+	require.ErrorContains(t, err, `invalid pattern "[deb.debian.org"`)
+}
+
+func TestParseDependencies(t *testing.T) {
+	t.Parallel()
+	var data = []byte(`openbsd-inetd
+  PreDepends: init-system-helpers
+  Depends: libc6
+ |Depends: tcpd
+  Depends: lsb-base
+telnetd
+  Depends: <inet-superserver>
+    openbsd-inetd
+    inetutils-inetd
+  Depends: libc6:amd64
+`)
+	require.Equal(t, map[string][]string{
+		"openbsd-inetd": {"init-system-helpers", "libc6", "tcpd", "lsb-base"},
+		"telnetd":       {"openbsd-inetd", "inetutils-inetd", "libc6"},
+	}, parseDependencies(data))
+}
+
+func TestLoadPolicyOnce(t *testing.T) {
+	t.Parallel()
+	var loads int
+	var load = func() (*packagePolicy, error) {
+		loads++
+		return &packagePolicy{Deny: []string{"telnetd"}}, nil
+	}
+	var checks = &packageChecks{}
+	for range 2 {
+		policy, err := checks.loadPolicy(load)
+		require.NoError(t, err)
+		require.Equal(t, []string{"telnetd"}, policy.Deny)
+	}
+	require.Equal(t, 1, loads)
+
+	// Without shared checks, the policy is loaded each time.
+	var none *packageChecks
+	_, err := none.loadPolicy(load)
+	require.NoError(t, err)
+	require.Equal(t, 2, loads)
+}
+
+func TestDependencyChain(t *testing.T) {
+	t.Parallel()
+	var deps = map[string][]string{
+		"curl":      {"libcurl4", "libc6"},
+		"libcurl4":  {"libldap-2", "libc6"},
+		"libldap-2": {"libc6"},
+	}
+	require.Equal(t, []string{"curl", "libcurl4", "libldap-2"}, dependencyChain(deps, []string{"git", "curl"}, "libldap-2"))
+	require.Equal(t, []string{"curl"}, dependencyChain(deps, []string{"curl"}, "curl"))
+	require.Equal(t, []string{"telnetd"}, dependencyChain(deps, []string{"curl"}, "telnetd"))
+}
+
+func TestCheckPolicy(t *testing.T) {
+	t.Parallel()
+	var source = []byte("FROM debian\nADD --apt git curl=7.88.1-10\n")
+	ast, err := parser.Parse(bytes.NewReader(source))
+	require.NoError(t, err)
+	cmd, err := instructions.ParseInstruction(ast.AST.Children[1])
+	require.NoError(t, err)
+	var i = NewPackageInvocation(&dispatchState{}, cmd.(*instructions.PackageCommand), nil, dispatchOpt{
+		sourceMap: llb.NewSourceMap(nil, "Dockerfile", "", source),
+	})
+	var files = []PackageDownload{
+		{uri: "https://deb.debian.org/debian/pool/main/g/git/git_2.39.5-0_amd64.deb", filename: "git_2.39.5-0_amd64.deb"},
+		{uri: "http://deb.debian.org/debian/pool/main/c/curl/curl_7.88.1-10_amd64.deb", filename: "curl_7.88.1-10_amd64.deb"},
+		{uri: "https://apt.example.com/pool/libldap-2_2.5.13_amd64.deb", filename: "libldap-2_2.5.13_amd64.deb"},
+	}
+	var deps = map[string][]string{
+		"curl":     {"libcurl4"},
+		"libcurl4": {"libldap-2"},
+	}
+	require.NoError(t, i.CheckPolicy(nil, files, deps))
+	require.NoError(t, i.CheckPolicy(&packagePolicy{Deny: []string{"telnetd"}}, files, deps))
+
+	err = i.CheckPolicy(&packagePolicy{Deny: []string{"libldap-*"}}, files, deps)
+	require.EqualError(t, err, "apt policy forbids package libldap-2 (pulled in by curl -> libcurl4 -> libldap-2)")
+	var el *parser.LocationError
+	require.ErrorAs(t, err, &el)
+	require.Equal(t, []parser.Range{{
+		Start: parser.Position{Line: 2, Character: 14},
+		End:   parser.Position{Line: 2, Character: 28},
+	}}, el.Locations[0])
+
+	err = i.CheckPolicy(&packagePolicy{Allow: []string{"git", "curl", "libcurl4"}}, files, deps)
+	require.EqualError(t, err, "apt policy doesn't allow package libldap-2 (pulled in by curl -> libcurl4 -> libldap-2)")
+
+	err = i.CheckPolicy(&packagePolicy{RequireHTTPS: true, AllowedHosts: []string{"*.debian.org"}}, files, deps)
+	require.EqualError(t, err, "apt policy requires HTTPS, but curl comes from "+files[1].uri+"; "+
+		"doesn't allow host apt.example.com, where libldap-2 comes from (pulled in by curl -> libcurl4 -> libldap-2)")
+}
+
+func TestCheckPolicyPackageFiles(t *testing.T) {
+	t.Parallel()
+	var i = NewPackageInvocation(&dispatchState{}, &instructions.PackageCommand{
+		PackageNames: []string{"./telnetd_0.17_amd64.deb", "https://example.com/vendor.deb"},
+	}, nil, dispatchOpt{})
+	i.packageFiles = map[int]packageRecord{
+		0: {PackageDownload: PackageDownload{filename: "telnetd_0.17_amd64.deb"}, name: "telnetd"},
+		1: {PackageDownload: PackageDownload{uri: "https://example.com/vendor.deb", filename: "vendor.deb"},
+			name: "rsh-server"},
+	}
+	require.NoError(t, i.CheckPolicy(&packagePolicy{RequireHTTPS: true, AllowedHosts: []string{"example.com"}}, nil, nil))
+
+	var err = i.CheckPolicy(&packagePolicy{Deny: []string{"telnetd", "rsh-*"}}, nil, nil)
+	require.EqualError(t, err, "apt policy forbids package telnetd; forbids package rsh-server")
+
+	err = i.CheckPolicy(&packagePolicy{Allow: []string{"telnetd"}}, nil, nil)
+	require.EqualError(t, err, "apt policy doesn't allow package rsh-server")
+}
@@ -0,0 +1,159 @@
+package dockerfile2llb
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/dockerui"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// packageSBOMName is the key for package SBOMs in `SBOMTargets.Extras`. The
+// scanner reads the SPDX document out of the extra's filesystem, so it can
+// report apt's view of the packages without re-scanning the dpkg database.
+const packageSBOMName = "apt-packages"
+
+// spdxChecksumAlgorithms maps apt's names for hash types to SPDX's.
+var spdxChecksumAlgorithms = map[string]string{
+	"MD5SUM": "MD5",
+	"SHA1":   "SHA1",
+	"SHA256": "SHA256",
+	"SHA512": "SHA512",
+}
+
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships,omitempty"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	Name             string            `json:"name"`
+	SPDXID           string            `json:"SPDXID"`
+	VersionInfo      string            `json:"versionInfo,omitempty"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	Checksums        []spdxChecksum    `json:"checksums,omitempty"`
+	ExternalRefs     []spdxExternalRef `json:"externalRefs,omitempty"`
+}
+
+type spdxChecksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// packageSBOM returns a state containing an SPDX document that lists the
+// packages installed in the given stage, if there are any.
+func packageSBOM(ds *dispatchState) (llb.State, bool, error) {
+	if len(ds.packages) == 0 {
+		return llb.State{}, false, nil
+	}
+	dt, err := json.MarshalIndent(newPackageSPDX(ds.packages, ds.epoch), "", "  ")
+	if err != nil {
+		return llb.State{}, false, errors.Wrap(err, "failed to generate package SBOM")
+	}
+	var opts = []llb.ConstraintsOpt{dockerui.WithInternalName("generating package SBOM")}
+	if ds.platform != nil {
+		opts = append(opts, llb.Platform(*ds.platform))
+	}
+	return llb.Scratch().File(llb.Mkfile("/"+packageSBOMName+".spdx.json", 0o644, dt), opts...), true, nil
+}
+
+func newPackageSPDX(packages []packageRecord, epoch *time.Time) spdxDocument {
+	var doc = spdxDocument{
+		SPDXVersion: "SPDX-2.3",
+		DataLicense: "CC0-1.0",
+		SPDXID:      "SPDXRef-DOCUMENT",
+		Name:        packageSBOMName,
+		CreationInfo: spdxCreationInfo{
+			Creators: []string{"Tool: btidor/syntax"},
+		},
+	}
+	for n, p := range packages {
+		var pkg = spdxPackage{
+			Name:             p.name,
+			SPDXID:           fmt.Sprintf("SPDXRef-Package-deb-%d", n),
+			VersionInfo:      p.version,
+			DownloadLocation: p.uri,
+		}
+		if pkg.DownloadLocation == "" {
+			// A .deb file from the build context.
+			pkg.DownloadLocation = "NOASSERTION"
+		}
+		for _, hash := range slices.Sorted(maps.Keys(p.hashes)) {
+			if algorithm, ok := spdxChecksumAlgorithms[hash]; ok {
+				pkg.Checksums = append(pkg.Checksums,
+					spdxChecksum{Algorithm: algorithm, ChecksumValue: p.hashes[hash]})
+			}
+		}
+		if purl := p.purl(); purl != "" {
+			pkg.ExternalRefs = []spdxExternalRef{{
+				ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  purl,
+			}}
+		}
+		doc.Packages = append(doc.Packages, pkg)
+		doc.Relationships = append(doc.Relationships, spdxRelationship{
+			SPDXElementID:      doc.SPDXID,
+			RelationshipType:   "DESCRIBES",
+			RelatedSPDXElement: pkg.SPDXID,
+		})
+	}
+
+	// The namespace must be unique per document, so derive it from the
+	// contents. The creation time is left out to keep it stable.
+	dt, _ := json.Marshal(doc.Packages)
+	doc.DocumentNamespace = "https://github.com/btidor/syntax/spdx/" + digest.FromBytes(dt).Encoded()
+
+	// SPDX requires a creation time, but the wall clock would change the
+	// document on every build. Without SOURCE_DATE_EPOCH, use the Unix epoch.
+	var created = time.Unix(0, 0)
+	if epoch != nil {
+		created = *epoch
+	}
+	doc.CreationInfo.Created = created.UTC().Format(time.RFC3339)
+	return doc
+}
+
+// purl returns the package URL for the package, following the `deb` type
+// from the purl specification.
+func (p packageRecord) purl() string {
+	if p.vendor == "" || p.version == "" {
+		return ""
+	}
+	var purl = fmt.Sprintf("pkg:deb/%s/%s@%s", url.PathEscape(p.vendor),
+		url.PathEscape(p.name), url.PathEscape(p.version))
+	if p.arch != "" {
+		purl += "?arch=" + url.QueryEscape(p.arch)
+	}
+	return purl
+}
@@ -0,0 +1,51 @@
+package dockerfile2llb
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPackageSPDX(t *testing.T) {
+	t.Parallel()
+	epoch := time.Unix(1700000000, 0)
+	packages := []packageRecord{
+		newPackageRecord(PackageDownload{
+			uri:      "http://deb.debian.org/debian/pool/main/s/sl/sl_5.02-1%2bb1_amd64.deb",
+			filename: "sl_5.02-1+b1_amd64.deb",
+			size:     12980,
+			hashes:   map[string]string{"SHA256": "0123abcd", "MD5SUM": "4567"},
+		}, "debian", nil),
+	}
+
+	doc := newPackageSPDX(packages, &epoch)
+	require.Equal(t, "SPDX-2.3", doc.SPDXVersion)
+	require.Equal(t, "2023-11-14T22:13:20Z", doc.CreationInfo.Created)
+	require.Len(t, doc.Packages, 1)
+
+	pkg := doc.Packages[0]
+	require.Equal(t, "sl", pkg.Name)
+	require.Equal(t, "5.02-1+b1", pkg.VersionInfo)
+	require.Equal(t, packages[0].uri, pkg.DownloadLocation)
+	require.Equal(t, []spdxChecksum{
+		{Algorithm: "MD5", ChecksumValue: "4567"},
+		{Algorithm: "SHA256", ChecksumValue: "0123abcd"},
+	}, pkg.Checksums)
+	require.Equal(t, "pkg:deb/debian/sl@5.02-1+b1?arch=amd64", pkg.ExternalRefs[0].ReferenceLocator)
+
+	// A .deb file from the build context has no download location or purl.
+	local := newPackageSPDX([]packageRecord{{name: "vendor-tool", version: "1.0-2"}}, &epoch).Packages[0]
+	require.Equal(t, "NOASSERTION", local.DownloadLocation)
+	require.Empty(t, local.ExternalRefs)
+
+	require.Equal(t, doc.DocumentNamespace, newPackageSPDX(packages, nil).DocumentNamespace)
+	require.Equal(t, "1970-01-01T00:00:00Z", newPackageSPDX(packages, nil).CreationInfo.Created)
+
+	_, ok, err := packageSBOM(&dispatchState{})
+	require.NoError(t, err)
+	require.False(t, ok)
+	_, ok, err = packageSBOM(&dispatchState{packages: packages, epoch: &epoch})
+	require.NoError(t, err)
+	require.True(t, ok)
+}
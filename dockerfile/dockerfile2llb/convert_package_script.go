@@ -0,0 +1,357 @@
+package dockerfile2llb
+
+import (
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/btidor/syntax/dockerfile/instructions"
+	"github.com/btidor/syntax/dockerfile/linter"
+)
+
+// shellCommand is a single simple command from a shell script, along with the
+// control operator that terminates it.
+type shellCommand struct {
+	words []string
+	op    string
+}
+
+// splitShellScript breaks a shell script into simple commands. It understands
+// quoting, comments and the list operators (`&&`, `||`, `;`, `|`, `&` and
+// newlines), which is enough to recognize package manager invocations.
+//
+// The second return value reports whether the script was simple enough to be
+// understood completely: scripts that use expansions, substitutions,
+// redirections, grouping or control flow are still split on a best-effort
+// basis, but must not be rewritten.
+func splitShellScript(script string) ([]shellCommand, bool) {
+	var (
+		cmds   []shellCommand
+		words  []string
+		word   strings.Builder
+		inWord bool
+		quote  byte
+		simple = true
+	)
+	flushWord := func() {
+		if inWord {
+			words = append(words, word.String())
+			word.Reset()
+			inWord = false
+		}
+	}
+	endCommand := func(op string) {
+		flushWord()
+		if len(words) > 0 {
+			cmds = append(cmds, shellCommand{words: words, op: op})
+		} else if op != "\n" && op != "" {
+			simple = false
+		}
+		words = nil
+	}
+
+	for i := 0; i < len(script); i++ {
+		c := script[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				word.WriteByte(c)
+			}
+		case quote == '"':
+			switch {
+			case c == '"':
+				quote = 0
+			case c == '\\' && i+1 < len(script) && strings.IndexByte("\"\\$`", script[i+1]) >= 0:
+				i++
+				word.WriteByte(script[i])
+			case c == '$' || c == '`':
+				simple = false
+				word.WriteByte(c)
+			default:
+				word.WriteByte(c)
+			}
+		default:
+			switch c {
+			case '\'', '"':
+				quote = c
+				inWord = true
+			case '\\':
+				if i+1 < len(script) {
+					i++
+					if script[i] != '\n' {
+						word.WriteByte(script[i])
+						inWord = true
+					}
+				}
+			case ' ', '\t', '\r':
+				flushWord()
+			case '\n', ';':
+				endCommand(string(c))
+			case '&', '|':
+				op := string(c)
+				if i+1 < len(script) && script[i+1] == c {
+					op += op
+					i++
+				}
+				endCommand(op)
+			case '#':
+				if inWord {
+					word.WriteByte(c)
+					continue
+				}
+				for i+1 < len(script) && script[i+1] != '\n' {
+					i++
+				}
+			case '$', '`', '(', ')', '<', '>':
+				simple = false
+				word.WriteByte(c)
+				inWord = true
+			default:
+				word.WriteByte(c)
+				inWord = true
+			}
+		}
+	}
+	if quote != 0 {
+		simple = false
+	}
+	endCommand("")
+
+	for _, cmd := range cmds {
+		switch cmd.words[0] {
+		case "if", "then", "else", "elif", "fi", "for", "while", "until",
+			"do", "done", "case", "esac", "function", "{", "}", "!":
+			simple = false
+		}
+	}
+	return cmds, simple
+}
+
+// runScripts returns the shell scripts executed by a RUN instruction. Exec
+// form commands are returned as a single command.
+func runScripts(c *instructions.RunCommand) []string {
+	if !c.PrependShell {
+		return nil
+	}
+	if len(c.Files) > 0 {
+		var scripts []string
+		for _, f := range c.Files {
+			scripts = append(scripts, f.Data)
+		}
+		return scripts
+	}
+	return []string{strings.Join(c.CmdLine, " ")}
+}
+
+// runCommands returns the simple commands executed by a RUN instruction, and
+// whether they were understood completely.
+func runCommands(c *instructions.RunCommand) ([]shellCommand, bool) {
+	if !c.PrependShell {
+		return []shellCommand{{words: c.CmdLine}}, true
+	}
+	var cmds []shellCommand
+	simple := len(c.Files) == 0
+	for _, script := range runScripts(c) {
+		parsed, ok := splitShellScript(script)
+		cmds = append(cmds, parsed...)
+		simple = simple && ok
+	}
+	return cmds, simple
+}
+
+// aptCommand is an invocation of apt or apt-get.
+type aptCommand struct {
+	tool    string
+	action  string
+	options []string
+	args    []string
+}
+
+// aptValueOptions are the apt-get options that consume the following word.
+var aptValueOptions = map[string]struct{}{
+	"-o": {}, "--option": {},
+	"-c": {}, "--config-file": {},
+	"-t": {}, "--target-release": {}, "--default-release": {},
+	"-a": {}, "--host-architecture": {},
+}
+
+// parseAptCommand recognizes an apt or apt-get invocation, optionally preceded
+// by environment assignments, `env` or `sudo`.
+func parseAptCommand(words []string) (aptCommand, bool) {
+	for len(words) > 0 {
+		w := words[0]
+		if w == "env" || w == "sudo" || isEnvAssignment(w) {
+			words = words[1:]
+			continue
+		}
+		break
+	}
+	if len(words) == 0 {
+		return aptCommand{}, false
+	}
+	cmd := aptCommand{tool: path.Base(words[0])}
+	if cmd.tool != "apt-get" && cmd.tool != "apt" {
+		return aptCommand{}, false
+	}
+	for i := 1; i < len(words); i++ {
+		w := words[i]
+		switch {
+		case strings.HasPrefix(w, "-"):
+			cmd.options = append(cmd.options, w)
+			if _, ok := aptValueOptions[w]; ok && i+1 < len(words) {
+				i++
+				cmd.options = append(cmd.options, words[i])
+			}
+		case cmd.action == "":
+			cmd.action = w
+		default:
+			cmd.args = append(cmd.args, w)
+		}
+	}
+	return cmd, true
+}
+
+var envAssignmentRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+
+func isEnvAssignment(w string) bool {
+	return envAssignmentRegex.MatchString(w)
+}
+
+// plainPackageRegex matches package names, optionally with an architecture
+// qualifier or a pinned version.
+var plainPackageRegex = regexp.MustCompile(`^[a-z0-9][a-z0-9+.-]+(:[a-z0-9-]+)?(=[A-Za-z0-9.+~:-]+)?$`)
+
+// plainInstallOptions are the apt-get install options that don't change what
+// gets installed, so the install can be expressed as `ADD --apt`.
+var plainInstallOptions = map[string]struct{}{
+	"-y": {}, "--yes": {}, "--assume-yes": {},
+	"-q": {}, "-qq": {}, "--quiet": {}, "--quiet=1": {}, "--quiet=2": {},
+}
+
+// hasPlainOptions reports whether the command only uses options that don't
+// change its behavior.
+func (c aptCommand) hasPlainOptions() bool {
+	for _, opt := range c.options {
+		if _, ok := plainInstallOptions[opt]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// isPlainInstall reports whether the command installs a list of packages from
+// the configured repositories without any special options.
+func (c aptCommand) isPlainInstall() bool {
+	if c.action != "install" || len(c.args) == 0 || !c.hasPlainOptions() {
+		return false
+	}
+	for _, arg := range c.args {
+		if !plainPackageRegex.MatchString(arg) {
+			return false
+		}
+	}
+	return true
+}
+
+// removesPath reports whether the command is an `rm` of a path under dir.
+func removesPath(words []string, dir string) bool {
+	if len(words) == 0 || path.Base(words[0]) != "rm" {
+		return false
+	}
+	for _, w := range words[1:] {
+		if strings.HasPrefix(w, "-") {
+			continue
+		}
+		if w == dir || strings.HasPrefix(w, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// rewriteAptRuns replaces the RUN instructions that rewriteAptRun recognizes
+// with equivalent package commands, warning about each one.
+func rewriteAptRuns(cmds []instructions.Command, lint *linter.Linter) []instructions.Command {
+	cmds = slices.Clone(cmds)
+	for i, cmd := range cmds {
+		run, ok := cmd.(*instructions.RunCommand)
+		if !ok {
+			continue
+		}
+		pc, ok := rewriteAptRun(run)
+		if !ok {
+			continue
+		}
+		cmds[i] = pc
+		cmdLint := lint.WithMergedConfigFromComments(run.Comments())
+		msg := linter.RuleAptInstallRewritten.Format(strings.Join(pc.PackageNames, " "))
+		cmdLint.Run(&linter.RuleAptInstallRewritten, run.Location(), msg)
+	}
+	return cmds
+}
+
+// rewriteAptRun recognizes RUN instructions of the form
+//
+//	RUN apt-get update && apt-get install -y pkgs... [&& rm -rf /var/lib/apt/lists/*]
+//
+// and returns an equivalent package command. Instructions that use any other
+// flags, options or shell features are left alone.
+func rewriteAptRun(run *instructions.RunCommand) (*instructions.PackageCommand, bool) {
+	if len(run.FlagsUsed) > 0 || !run.PrependShell || len(run.Files) > 0 {
+		return nil, false
+	}
+	cmds, simple := runCommands(run)
+	if !simple || len(cmds) < 2 || len(cmds) > 3 {
+		return nil, false
+	}
+	for i, cmd := range cmds {
+		if (i < len(cmds)-1 && cmd.op != "&&") || (i == len(cmds)-1 && cmd.op != "") {
+			return nil, false
+		}
+	}
+
+	update, ok := parseSimpleAptCommand(cmds[0].words)
+	if !ok || update.action != "update" || len(update.args) > 0 || !update.hasPlainOptions() {
+		return nil, false
+	}
+	install, ok := parseSimpleAptCommand(cmds[1].words)
+	if !ok || !install.isPlainInstall() {
+		return nil, false
+	}
+	if len(cmds) == 3 && !isListsCleanup(cmds[2].words) {
+		return nil, false
+	}
+	return instructions.NewPackageCommandFromRun(run, install.args), true
+}
+
+// parseSimpleAptCommand is like parseAptCommand, but only accepts a bare
+// apt-get, optionally with DEBIAN_FRONTEND=noninteractive (which the package
+// steps always set).
+func parseSimpleAptCommand(words []string) (aptCommand, bool) {
+	if len(words) > 0 && words[0] == "DEBIAN_FRONTEND=noninteractive" {
+		words = words[1:]
+	}
+	if len(words) == 0 || words[0] != "apt-get" {
+		return aptCommand{}, false
+	}
+	return parseAptCommand(words)
+}
+
+// isListsCleanup reports whether the command only removes the package lists.
+func isListsCleanup(words []string) bool {
+	if len(words) < 3 || words[0] != "rm" {
+		return false
+	}
+	for _, w := range words[1:] {
+		switch w {
+		case "-r", "-f", "-rf", "-fr", "-R", "-Rf", "-fR":
+		case "/var/lib/apt/lists", "/var/lib/apt/lists/", "/var/lib/apt/lists/*":
+		default:
+			return false
+		}
+	}
+	return removesPath(words, "/var/lib/apt/lists")
+}
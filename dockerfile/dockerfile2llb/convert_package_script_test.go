@@ -0,0 +1,154 @@
+package dockerfile2llb
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/btidor/syntax/dockerfile/instructions"
+	"github.com/btidor/syntax/dockerfile/linter"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitShellScript(t *testing.T) {
+	cmds, simple := splitShellScript(`apt-get update && DEBIAN_FRONTEND=noninteractive apt-get install -y "clang" nginx; rm -rf /var/lib/apt/lists/* # done`)
+	require.True(t, simple)
+	require.Equal(t, []shellCommand{
+		{words: []string{"apt-get", "update"}, op: "&&"},
+		{words: []string{"DEBIAN_FRONTEND=noninteractive", "apt-get", "install", "-y", "clang", "nginx"}, op: ";"},
+		{words: []string{"rm", "-rf", "/var/lib/apt/lists/*"}, op: ""},
+	}, cmds)
+
+	for _, script := range []string{
+		`apt-get install -y $PACKAGES`,
+		`apt-get install -y $(cat packages.txt)`,
+		`if true; then apt-get install -y clang; fi`,
+		`apt-get install -y clang > /dev/null`,
+		`apt-get install -y 'clang`,
+	} {
+		_, simple := splitShellScript(script)
+		require.False(t, simple, script)
+	}
+}
+
+func TestParseAptCommand(t *testing.T) {
+	cmd, ok := parseAptCommand([]string{"sudo", "env", "A=b", "/usr/bin/apt-get", "-o", "Foo=bar", "install", "-y", "clang", "nginx=1.2"})
+	require.True(t, ok)
+	require.Equal(t, aptCommand{
+		tool:    "apt-get",
+		action:  "install",
+		options: []string{"-o", "Foo=bar", "-y"},
+		args:    []string{"clang", "nginx=1.2"},
+	}, cmd)
+	require.False(t, cmd.isPlainInstall())
+
+	cmd, ok = parseAptCommand([]string{"apt-get", "install", "--yes", "-qq", "clang", "libc6:amd64"})
+	require.True(t, ok)
+	require.True(t, cmd.isPlainInstall())
+
+	cmd, ok = parseAptCommand([]string{"apt-get", "install", "-y", "./vendor.deb"})
+	require.True(t, ok)
+	require.False(t, cmd.isPlainInstall())
+
+	_, ok = parseAptCommand([]string{"apt-cache", "policy"})
+	require.False(t, ok)
+}
+
+func TestValidatePackageManagerUsage(t *testing.T) {
+	type warning struct {
+		rule string
+		line int
+	}
+	lintRun := func(t *testing.T, dockerfile string) []warning {
+		var warnings []warning
+		lint := linter.New(&linter.Config{
+			Warn: func(rulename, description, url, fmtmsg string, location []parser.Range) {
+				warnings = append(warnings, warning{rulename, location[0].Start.Line})
+			},
+		})
+		ast, err := parser.Parse(bytes.NewBufferString(dockerfile))
+		require.NoError(t, err)
+		stages, _, err := instructions.Parse(ast.AST, lint)
+		require.NoError(t, err)
+		validatePackageManagerUsage(stages, lint)
+		return warnings
+	}
+
+	t.Run("recommended", func(t *testing.T) {
+		warnings := lintRun(t, `FROM debian
+RUN apt-get update && apt-get install -y clang && rm -rf /var/lib/apt/lists/*
+`)
+		require.Equal(t, []warning{{"AptGetInstallInRun", 2}}, warnings)
+	})
+
+	t.Run("separate update", func(t *testing.T) {
+		warnings := lintRun(t, `FROM debian
+RUN apt update
+RUN apt-get install -y --no-install-recommends clang
+`)
+		require.Equal(t, []warning{
+			{"AptInScript", 2},
+			{"AptUpdateInSeparateRun", 2},
+			{"AptListsNotRemoved", 3},
+		}, warnings)
+	})
+
+	t.Run("shared cache", func(t *testing.T) {
+		warnings := lintRun(t, `FROM debian
+RUN --mount=type=cache,target=/var/cache/apt \
+    --mount=type=cache,target=/var/lib/apt,sharing=locked \
+    rm -f /etc/apt/apt.conf.d/docker-clean && \
+    apt-get update && apt-get install -y $PACKAGES
+`)
+		require.Equal(t, []warning{{"AptDockerCleanShared", 2}}, warnings)
+	})
+
+	t.Run("check directive", func(t *testing.T) {
+		warnings := lintRun(t, `FROM debian
+# check=skip=AptListsNotRemoved,AptGetInstallInRun
+RUN apt-get update && apt-get install -y clang
+RUN apt-get update && apt-get install -y nginx
+`)
+		require.Equal(t, []warning{
+			{"AptGetInstallInRun", 4},
+			{"AptListsNotRemoved", 4},
+		}, warnings)
+	})
+}
+
+func TestRewriteAptRun(t *testing.T) {
+	for _, tc := range []struct {
+		line     string
+		packages []string
+	}{
+		{line: `RUN apt-get update && apt-get install -y clang nginx && rm -rf /var/lib/apt/lists/*`, packages: []string{"clang", "nginx"}},
+		{line: `RUN apt-get -qq update && DEBIAN_FRONTEND=noninteractive apt-get install --yes sl`, packages: []string{"sl"}},
+		{line: "RUN apt-get update && \\\n    apt-get install -y sl", packages: []string{"sl"}},
+		{line: `RUN apt-get install -y clang`},
+		{line: `RUN apt-get update; apt-get install -y clang`},
+		{line: `RUN apt-get update && apt-get install -y --no-install-recommends clang`},
+		{line: `RUN apt-get update && apt-get install -y $PACKAGES`},
+		{line: `RUN apt-get update && apt-get install -y clang && rm -rf /tmp/*`},
+		{line: `RUN apt-get update && apt-get install -y clang && make`},
+		{line: `RUN --network=none apt-get update && apt-get install -y clang`},
+		{line: `RUN ["sh", "-c", "apt-get update && apt-get install -y clang"]`},
+		{line: `RUN sudo apt-get update && sudo apt-get install -y clang`},
+	} {
+		t.Run(tc.line, func(t *testing.T) {
+			ast, err := parser.Parse(bytes.NewBufferString(tc.line))
+			require.NoError(t, err)
+			cmd, err := instructions.ParseInstruction(ast.AST.Children[0])
+			require.NoError(t, err)
+
+			run := cmd.(*instructions.RunCommand)
+			pc, ok := rewriteAptRun(run)
+			if tc.packages == nil {
+				require.False(t, ok)
+				return
+			}
+			require.True(t, ok)
+			require.Equal(t, tc.packages, pc.PackageNames)
+			require.Equal(t, run.Location(), pc.Location())
+		})
+	}
+}
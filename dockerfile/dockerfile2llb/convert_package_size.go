@@ -0,0 +1,99 @@
+package dockerfile2llb
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/docker/go-units"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/pkg/errors"
+)
+
+// summaryPackages is how many of the largest packages are named in download
+// summaries.
+const summaryPackages = 3
+
+// downloadSummary describes the packages to be downloaded, e.g. "12
+// packages, 32.9MiB (largest: a 19MiB, b 4.8MiB, c 1.9MiB)".
+func downloadSummary(files []PackageDownload) string {
+	var noun = "packages"
+	if len(files) == 1 {
+		noun = "package"
+	}
+	var summary = fmt.Sprintf("%d %s, %s", len(files), noun, units.BytesSize(float64(totalSize(files))))
+	if len(files) < 2 {
+		return summary
+	}
+	var largest = largestPackages(files)
+	return fmt.Sprintf("%s (largest: %s)", summary,
+		describePackageSizes(largest[:min(len(largest), summaryPackages)]))
+}
+
+func totalSize(files []PackageDownload) int64 {
+	var total int64
+	for _, file := range files {
+		total += int64(file.size)
+	}
+	return total
+}
+
+// largestPackages returns the packages ordered from largest to smallest.
+func largestPackages(files []PackageDownload) []PackageDownload {
+	return slices.SortedStableFunc(slices.Values(files), func(a, b PackageDownload) int {
+		return cmp.Compare(b.size, a.size)
+	})
+}
+
+func describePackageSizes(files []PackageDownload) string {
+	var parts []string
+	for _, file := range files {
+		var name, _, _ = parsePackageFilename(file.filename)
+		parts = append(parts, fmt.Sprintf("%s %s", name, units.BytesSize(float64(file.size))))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// maxDownloadSize returns the download budget for the command, from
+// `--max-download-size` or BUILDKIT_APT_MAX_DOWNLOAD_SIZE, or 0 if there's
+// no limit.
+func (i *PackageInvocation) maxDownloadSize() (int64, error) {
+	var value, source = i.cmd.MaxDownloadSize, "--max-download-size"
+	if value == "" {
+		value, source = i.dopt.buildArgValues[aptMaxDownloadSize], aptMaxDownloadSize
+	}
+	if value == "" {
+		return 0, nil
+	}
+	size, err := units.RAMInBytes(value)
+	if err != nil {
+		return 0, errors.Errorf("invalid value for %s: %s", source, value)
+	}
+	return size, nil
+}
+
+// CheckDownloadSize fails the build if the packages add up to more than the
+// download budget, naming the largest packages that pushed it over.
+func (i *PackageInvocation) CheckDownloadSize(files []PackageDownload) error {
+	limit, err := i.maxDownloadSize()
+	if err != nil || limit <= 0 {
+		return parser.WithLocation(err, i.cmd.Location())
+	}
+	var total = totalSize(files)
+	if total <= limit {
+		return nil
+	}
+	var over []PackageDownload
+	for _, file := range largestPackages(files) {
+		if total <= limit {
+			break
+		}
+		over = append(over, file)
+		total -= int64(file.size)
+	}
+	err = errors.Errorf("downloading %d packages (%s) exceeds the limit of %s; it's pushed over by %s",
+		len(files), units.BytesSize(float64(totalSize(files))), units.BytesSize(float64(limit)),
+		describePackageSizes(over))
+	return parser.WithLocation(err, i.cmd.Location())
+}
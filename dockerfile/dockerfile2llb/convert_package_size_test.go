@@ -0,0 +1,44 @@
+package dockerfile2llb
+
+import (
+	"testing"
+
+	"github.com/btidor/syntax/dockerfile/instructions"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadSummary(t *testing.T) {
+	t.Parallel()
+	var files = []PackageDownload{
+		{filename: "sl_5.02_amd64.deb", size: 12 << 10},
+		{filename: "gcc-12_12.2.0_amd64.deb", size: 20 << 20},
+		{filename: "cpp-12_12.2.0_amd64.deb", size: 9 << 20},
+		{filename: "libc6-dev_2.36_amd64.deb", size: 2 << 20},
+	}
+	require.Equal(t, "4 packages, 31.01MiB (largest: gcc-12 20MiB, cpp-12 9MiB, libc6-dev 2MiB)",
+		downloadSummary(files))
+	require.Equal(t, "1 package, 12KiB", downloadSummary(files[:1]))
+}
+
+func TestCheckDownloadSize(t *testing.T) {
+	t.Parallel()
+	var files = []PackageDownload{
+		{filename: "sl_5.02_amd64.deb", size: 12 << 10},
+		{filename: "gcc-12_12.2.0_amd64.deb", size: 20 << 20},
+		{filename: "cpp-12_12.2.0_amd64.deb", size: 9 << 20},
+	}
+	var cmd = &instructions.PackageCommand{PackageNames: []string{"gcc"}}
+	var i = &PackageInvocation{cmd: cmd}
+	require.NoError(t, i.CheckDownloadSize(files))
+
+	cmd.MaxDownloadSize = "10MiB"
+	require.EqualError(t, i.CheckDownloadSize(files),
+		"downloading 3 packages (29.01MiB) exceeds the limit of 10MiB; it's pushed over by gcc-12 20MiB")
+
+	cmd.MaxDownloadSize = ""
+	i.dopt.buildArgValues = map[string]string{aptMaxDownloadSize: "5m"}
+	require.ErrorContains(t, i.CheckDownloadSize(files), "it's pushed over by gcc-12 20MiB, cpp-12 9MiB")
+
+	cmd.MaxDownloadSize = "lots"
+	require.ErrorContains(t, i.CheckDownloadSize(files), "invalid value for --max-download-size: lots")
+}
@@ -0,0 +1,706 @@
+package dockerfile2llb
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/btidor/syntax/dockerfile/instructions"
+	"github.com/btidor/syntax/dockerfile/linter"
+	"github.com/btidor/syntax/dockerfile/shell"
+	"github.com/moby/buildkit/client/llb"
+	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/moby/buildkit/solver/pb"
+	digest "github.com/opencontainers/go-digest"
+	ocispecs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseURIs(t *testing.T) {
+	t.Parallel()
+	i := &PackageInvocation{}
+
+	out := []byte(`'http://deb.debian.org/debian/pool/main/s/sl/sl_5.02-1%2bb1_amd64.deb' sl_5.02-1+b1_amd64.deb 12980 SHA256:0123abcd
+'file:/btidor.syntax/mirror/pool/main/n/nginx/nginx_1.22.1-9_all.deb' nginx_1.22.1-9_all.deb 38752
+'http://example.com/pool/c/curl/curl_8.5_amd64.deb' curl_8.5_amd64.deb 315 MD5Sum:89ef SHA256:0123ABCD SHA512:4567cdef
+`)
+	uris, err := i.ParseURIs(out)
+	require.NoError(t, err)
+	require.Equal(t, []PackageDownload{
+		{
+			uri:      "http://deb.debian.org/debian/pool/main/s/sl/sl_5.02-1%2bb1_amd64.deb",
+			filename: "sl_5.02-1+b1_amd64.deb",
+			size:     12980,
+			hashes:   map[string]string{"SHA256": "0123abcd"},
+		},
+		{
+			uri:      "file:/btidor.syntax/mirror/pool/main/n/nginx/nginx_1.22.1-9_all.deb",
+			filename: "nginx_1.22.1-9_all.deb",
+			size:     38752,
+		},
+		{
+			uri:      "http://example.com/pool/c/curl/curl_8.5_amd64.deb",
+			filename: "curl_8.5_amd64.deb",
+			size:     315,
+			hashes:   map[string]string{"MD5SUM": "89ef", "SHA256": "0123ABCD", "SHA512": "4567cdef"},
+		},
+	}, uris)
+	require.Equal(t, digest.Digest("sha256:0123abcd"), uris[0].digest())
+	require.Empty(t, uris[1].digest())
+	require.Equal(t, digest.Digest("sha256:0123abcd"), uris[2].digest())
+	require.Equal(t, digest.Digest("sha512:4567cdef"),
+		PackageDownload{hashes: map[string]string{"SHA512": "4567CDEF"}}.digest())
+	require.Empty(t, PackageDownload{hashes: map[string]string{"MD5SUM": "89ef"}}.digest())
+
+	_, err = i.ParseURIs([]byte("E: Unable to locate package foo\n"))
+	require.ErrorContains(t, err, "could not parse apt uri line")
+}
+
+func TestDownloadFilesFromMirror(t *testing.T) {
+	t.Parallel()
+	mirror := &dispatchState{state: llb.Image("example.com/apt-mirror")}
+	i := &PackageInvocation{
+		d:      &dispatchState{},
+		cmd:    &instructions.PackageCommand{PackageNames: []string{"nginx"}},
+		mirror: mirror,
+	}
+
+	st, err := i.DownloadFiles(llb.Scratch(), []PackageDownload{{
+		uri:      "file:/btidor.syntax/mirror/pool/main/n/nginx/nginx_1%3a1.22_all.deb",
+		filename: "nginx_1%3a1.22_all.deb",
+		size:     38752,
+		hashes:   map[string]string{"SHA256": "AB12"},
+	}}, "/btidor.syntax/cache/archives/")
+	require.NoError(t, err)
+
+	ops, copies := marshalCopies(t, st)
+	for _, op := range ops {
+		require.False(t, strings.HasPrefix(op.GetSource().GetIdentifier(), "http"),
+			"mirror packages must not be fetched over http")
+	}
+	require.Len(t, copies, 1)
+	require.Equal(t, "/pool/main/n/nginx/nginx_1:1.22_all.deb", copies[0].Src)
+	require.Equal(t, "/btidor.syntax/cache/archives/nginx_1%3a1.22_all.deb", copies[0].Dest)
+	var mkfiles = fileMkfiles(ops)
+	require.Len(t, mkfiles, 1)
+	require.Equal(t, "ab12  /btidor.syntax/cache/archives/nginx_1%3a1.22_all.deb\n", string(mkfiles[0].Data))
+	require.Equal(t, []string{"sha256sum --check --quiet /btidor.syntax/sha256sums"}, execScripts(ops))
+
+	i.mirror = nil
+	_, err = i.DownloadFiles(llb.Scratch(), []PackageDownload{{
+		uri:      "file:/btidor.syntax/mirror/pool/main/s/sl/sl_5.02_amd64.deb",
+		filename: "sl_5.02_amd64.deb",
+	}}, "/btidor.syntax/cache/archives/")
+	require.ErrorContains(t, err, "unexpected local package uri")
+}
+
+func TestExportDownloadedPackages(t *testing.T) {
+	t.Parallel()
+	d := &dispatchState{
+		state:    llb.Image("debian").Dir("/work"),
+		platform: &ocispecs.Platform{OS: "linux", Architecture: "amd64"},
+		cmdTotal: 3,
+	}
+	c := &instructions.PackageCommand{PackageNames: []string{"sl"}, DownloadOnly: "repo", Index: true}
+	i := NewPackageInvocation(d, c, nil, dispatchOpt{})
+	require.Equal(t, "[3/3] ADD (apt export) sl", i.installStage)
+	require.True(t, i.resolvesFromScratch())
+	c.Upgrade = true
+	require.False(t, i.resolvesFromScratch())
+	c.Upgrade = false
+
+	require.NoError(t, i.Export(llb.Scratch()))
+	require.Len(t, d.image.History, 1)
+	require.False(t, d.image.History[0].EmptyLayer)
+
+	ops, _ := marshalCopies(t, d.state)
+	var scripts = execScripts(ops)
+	require.Len(t, scripts, 1)
+	require.Contains(t, scripts[0], "mkdir -p '/work/repo'")
+	require.Contains(t, scripts[0], "-exec cp -t '/work/repo' {} +")
+	require.Contains(t, scripts[0], "> Packages")
+}
+
+func TestLinkedExport(t *testing.T) {
+	t.Parallel()
+	caps := pb.Caps.CapSet(pb.Caps.All())
+	base := llb.Image("debian")
+	d := &dispatchState{
+		state:    base.File(llb.Mkdir("/earlier", 0o755)).Dir("/work"),
+		linkBase: base,
+		platform: &ocispecs.Platform{OS: "linux", Architecture: "amd64"},
+		cmdTotal: 3,
+	}
+	c := &instructions.PackageCommand{PackageNames: []string{"sl"}, DownloadOnly: "repo", Link: true}
+	i := NewPackageInvocation(d, c, nil, dispatchOpt{llbCaps: &caps})
+	require.True(t, i.linked())
+	require.NoError(t, i.Export(llb.Scratch()))
+	require.Len(t, d.image.History, 1)
+
+	ops, _ := marshalCopies(t, d.state)
+	var mkdir digest.Digest
+	var exec *pb.Op
+	var merges, diffs int
+	for _, op := range ops {
+		switch {
+		case op.GetFile() != nil:
+			dt, err := op.MarshalVT()
+			require.NoError(t, err)
+			mkdir = digest.FromBytes(dt)
+		case op.GetExec() != nil:
+			exec = op
+		case op.GetMerge() != nil:
+			merges++
+		case op.GetDiff() != nil:
+			diffs++
+		}
+	}
+	require.Equal(t, 1, merges)
+	require.Equal(t, 1, diffs)
+	require.NotNil(t, exec)
+	// The export runs on the stage's base, not on the earlier layer.
+	for _, input := range exec.Inputs {
+		require.NotEqual(t, mkdir.String(), input.Digest)
+	}
+
+	// Without merge and diff support, --link falls back to a regular layer.
+	i = NewPackageInvocation(d, c, nil, dispatchOpt{})
+	require.False(t, i.linked())
+}
+
+func TestLinkedInstallAfterPackageChanges(t *testing.T) {
+	t.Parallel()
+	caps := pb.Caps.CapSet(pb.Caps.All())
+	d := &dispatchState{linkBase: llb.Image("debian")}
+	c := &instructions.PackageCommand{PackageNames: []string{"sl"}, Link: true}
+	i := NewPackageInvocation(d, c, nil, dispatchOpt{llbCaps: &caps})
+	require.True(t, i.linked())
+
+	// After a RUN or another install, a linked layer would replace the
+	// package database, so the install falls back to a regular layer.
+	d.packagesChangedAt = []parser.Range{{Start: parser.Position{Line: 2}}}
+	require.False(t, i.linked())
+
+	// Exports don't touch the package database, so they stay linked.
+	c.DownloadOnly = "repo"
+	require.True(t, i.linked())
+}
+
+func TestUnpackIntoRoot(t *testing.T) {
+	t.Parallel()
+	d := &dispatchState{
+		state:    llb.Scratch(),
+		platform: &ocispecs.Platform{OS: "linux", Architecture: "amd64"},
+		cmdTotal: 3,
+		stage:    instructions.Stage{BaseName: "scratch"},
+	}
+	from := &dispatchState{state: llb.Image("debian"), dispatched: true}
+	c := &instructions.PackageCommand{PackageNames: []string{"libssl3"}, Root: "/", From: "debian", DpkgStatus: true}
+	i := NewPackageInvocation(d, c, []*dispatchState{from}, dispatchOpt{})
+	require.Equal(t, from, i.from)
+	require.Nil(t, i.mirror)
+	require.Equal(t, "[3/3] ADD (apt unpack) libssl3", i.installStage)
+
+	require.NoError(t, i.Unpack(llb.Image("debian")))
+	require.Len(t, d.image.History, 1)
+	require.False(t, d.image.History[0].EmptyLayer)
+
+	ops, copies := marshalCopies(t, d.state)
+	var scripts = execScripts(ops)
+	require.Len(t, scripts, 1)
+	require.Contains(t, scripts[0], `[ -e "$f" ] || continue; dpkg-deb -x "$f" /btidor.syntax/root`)
+	require.Contains(t, scripts[0], "/btidor.syntax/root/var/lib/dpkg/status")
+	require.Len(t, copies, 1)
+	require.Equal(t, "/", copies[0].Dest)
+	require.True(t, copies[0].DirCopyContents)
+
+	// Without --from, a scratch stage has no apt to resolve packages with.
+	c = &instructions.PackageCommand{PackageNames: []string{"libssl3"}, Root: "/"}
+	err := NewPackageInvocation(d, c, nil, dispatchOpt{}).Dispatch()
+	require.ErrorContains(t, err, "needs --from")
+}
+
+func TestPackageGroups(t *testing.T) {
+	t.Parallel()
+	d := &dispatchState{
+		state:    llb.Image("debian"),
+		platform: &ocispecs.Platform{OS: "linux", Architecture: "amd64"},
+		packages: []packageRecord{{name: "gcc", group: "build-deps"}, {name: "curl"}},
+	}
+	skip := dispatchOpt{skipPackages: true}
+	for _, c := range []*instructions.PackageCommand{
+		{PackageNames: []string{"gcc", "make=4.3-4.1"}, Group: "build-deps"},
+		{PackageNames: []string{"curl"}},
+		{PackageNames: []string{"libc6-dev"}, Group: "build-deps"},
+	} {
+		require.NoError(t, NewPackageInvocation(d, c, nil, skip).Dispatch())
+	}
+	require.Equal(t, map[string][]string{"build-deps": nil}, d.packageGroups)
+
+	// Members are the packages that apt's plan installs anew.
+	d.packageGroups["build-deps"] = []string{"gcc", "make", "libc6-dev"}
+
+	d.cmdTotal = 1
+	c := &instructions.PackageCommand{Remove: "build-deps"}
+	require.Equal(t, 1, commandStepCount(c))
+	i := NewPackageInvocation(d, c, nil, dispatchOpt{})
+	require.Equal(t, "[1/1] ADD (apt remove) build-deps", i.installStage)
+	require.NoError(t, i.Dispatch())
+	require.Empty(t, d.packageGroups)
+	require.Equal(t, []packageRecord{{name: "curl"}}, d.packages)
+	require.Len(t, d.image.History, 1)
+
+	ops, _ := marshalCopies(t, d.state)
+	var scripts = execScripts(ops)
+	require.Len(t, scripts, 1)
+	var script = scripts[0]
+	require.Contains(t, script, " && apt-mark auto --quiet 'gcc' 'make' 'libc6-dev' > /dev/null && ")
+	require.Contains(t, script, " && apt-get autoremove --purge --simulate --quiet | "+
+		`sed -n 's/^Purg \([^ ]*\).*/\1/p' | grep -Fx -e 'gcc' -e 'make' -e 'libc6-dev' | `+
+		"xargs -r apt-get purge --yes --quiet && ")
+
+	d.packageGroups = map[string][]string{"build-deps": {"gcc"}}
+	c = &instructions.PackageCommand{Remove: "build-dep"}
+	err := NewPackageInvocation(d, c, nil, skip).Dispatch()
+	require.ErrorContains(t, err, `package group "build-dep" could not be found`)
+	require.ErrorContains(t, err, "did you mean build-deps?")
+}
+
+func TestDebconf(t *testing.T) {
+	t.Parallel()
+	c := &instructions.PackageCommand{
+		PackageNames:    []string{"tzdata"},
+		Debconf:         "debconf.conf",
+		DebconfHeredocs: []string{"tzdata tzdata/Areas select Etc\n"},
+	}
+	i := NewPackageInvocation(&dispatchState{}, c, nil, dispatchOpt{buildContext: llb.Local("context")})
+	tmp, script := i.Debconf(llb.Scratch())
+	require.Equal(t, []string{"debconf-set-selections " +
+		"/btidor.syntax/debconf/context /btidor.syntax/debconf/heredoc-0"}, script)
+
+	ops, copies := marshalCopies(t, tmp)
+	require.Len(t, copies, 1)
+	require.Equal(t, "/debconf.conf", copies[0].Src)
+	require.Equal(t, "/btidor.syntax/debconf/context", copies[0].Dest)
+	var mkfiles = fileMkfiles(ops)
+	require.Len(t, mkfiles, 1)
+	require.Equal(t, "/btidor.syntax/debconf/heredoc-0", mkfiles[0].Path)
+	require.Equal(t, c.DebconfHeredocs[0], string(mkfiles[0].Data))
+
+	_, script = NewPackageInvocation(&dispatchState{}, &instructions.PackageCommand{}, nil, dispatchOpt{}).Debconf(llb.Scratch())
+	require.Empty(t, script)
+}
+
+func TestParseReleaseDate(t *testing.T) {
+	t.Parallel()
+	date, ok := parseReleaseDate([]byte(`-----BEGIN PGP SIGNED MESSAGE-----
+Hash: SHA512
+
+Origin: Debian
+Suite: stable
+Date: Sat, 10 Aug 2024 09:37:42 UTC
+Valid-Until: Sat, 17 Aug 2024 09:37:42 UTC
+`))
+	require.True(t, ok)
+	require.Equal(t, time.Date(2024, 8, 10, 9, 37, 42, 0, time.UTC), date.UTC())
+
+	date, ok = parseReleaseDate([]byte("Date: Tue, 06 Aug 2024 12:00:00 +0000\n"))
+	require.True(t, ok)
+	require.Equal(t, time.Date(2024, 8, 6, 12, 0, 0, 0, time.UTC), date.UTC())
+
+	_, ok = parseReleaseDate([]byte("Origin: Ubuntu\n"))
+	require.False(t, ok)
+}
+
+func TestSlimOptions(t *testing.T) {
+	t.Parallel()
+	i := &PackageInvocation{cmd: &instructions.PackageCommand{Slim: []string{"doc", "man"}}}
+	require.Equal(t, " --option 'DPkg::Options::=--path-exclude=/usr/share/doc/*'"+
+		" --option 'DPkg::Options::=--path-exclude=/usr/share/doc-base/*'"+
+		" --option 'DPkg::Options::=--path-exclude=/usr/share/info/*'"+
+		" --option 'DPkg::Options::=--path-exclude=/usr/share/man/*'"+
+		" --option 'DPkg::Options::=--path-include=/usr/share/doc/*/copyright'",
+		i.slimOptions())
+
+	i = &PackageInvocation{cmd: &instructions.PackageCommand{}}
+	require.Empty(t, i.slimOptions())
+}
+
+func TestParsePackageFilename(t *testing.T) {
+	t.Parallel()
+	name, version, arch := parsePackageFilename("clang_1%3a14.0-55.7_amd64.deb")
+	require.Equal(t, "clang", name)
+	require.Equal(t, "1:14.0-55.7", version)
+	require.Equal(t, "amd64", arch)
+
+	name, version, arch = parsePackageFilename("weird.deb")
+	require.Equal(t, "weird.deb", name)
+	require.Empty(t, version)
+	require.Empty(t, arch)
+}
+
+func TestParseOSRelease(t *testing.T) {
+	t.Parallel()
+	release := parseOSRelease([]byte(`PRETTY_NAME="Debian GNU/Linux 12 (bookworm)"
+# comment
+ID=debian
+VERSION_CODENAME=bookworm
+`))
+	require.Equal(t, "debian", release["ID"])
+	require.Equal(t, "bookworm", release["VERSION_CODENAME"])
+	require.Equal(t, "Debian GNU/Linux 12 (bookworm)", release["PRETTY_NAME"])
+}
+
+func TestDownloadFilesProvenance(t *testing.T) {
+	t.Parallel()
+	df := "FROM debian\nADD --apt sl\n"
+	ast, err := parser.Parse(strings.NewReader(df))
+	require.NoError(t, err)
+	c, err := instructions.ParseInstruction(ast.AST.Children[1])
+	require.NoError(t, err)
+
+	i := &PackageInvocation{
+		cmd:  c.(*instructions.PackageCommand),
+		dopt: dispatchOpt{sourceMap: llb.NewSourceMap(nil, "Dockerfile", "Dockerfile", []byte(df))},
+	}
+	uri := "http://deb.debian.org/debian/pool/main/s/sl/sl_5.02-1%2bb1_amd64.deb"
+	st, err := i.DownloadFiles(llb.Scratch(), []PackageDownload{{
+		uri:      uri,
+		filename: "sl_5.02-1+b1_amd64.deb",
+		hashes:   map[string]string{"SHA256": "0123abcd"},
+	}}, "/btidor.syntax/cache/archives/")
+	require.NoError(t, err)
+
+	def, err := st.Marshal(context.TODO())
+	require.NoError(t, err)
+	var found bool
+	for dgst, meta := range def.Metadata {
+		if meta.Description[packageDescriptionKey] == "" {
+			continue
+		}
+		found = true
+		require.Equal(t, "sl=5.02-1+b1", meta.Description[packageDescriptionKey])
+		require.Equal(t, uri, meta.Description[packageDescriptionKey+".uri"])
+		require.Equal(t, "[apt] sl 5.02-1+b1", meta.Description["llb.customname"])
+		require.Contains(t, def.Source.Locations, dgst.String())
+	}
+	require.True(t, found)
+}
+
+func TestDownloadFilesWithSHA512(t *testing.T) {
+	t.Parallel()
+	i := &PackageInvocation{
+		d:   &dispatchState{},
+		cmd: &instructions.PackageCommand{PackageNames: []string{"sl", "curl"}},
+	}
+	st, err := i.DownloadFiles(llb.Scratch(), []PackageDownload{{
+		uri:      "http://archive.ubuntu.com/ubuntu/pool/universe/s/sl/sl_5.02-1_amd64.deb",
+		filename: "sl_5.02-1_amd64.deb",
+		hashes:   map[string]string{"SHA512": "4567CDEF"},
+	}, {
+		uri:      "http://archive.ubuntu.com/ubuntu/pool/main/c/curl/curl_8.5_amd64.deb",
+		filename: "curl_8.5_amd64.deb",
+		hashes:   map[string]string{"SHA256": "0123abcd", "SHA512": "89ef"},
+	}}, "/btidor.syntax/cache/archives/")
+	require.NoError(t, err)
+
+	// BuildKit checks only SHA-256, so the SHA-512 download is verified
+	// afterwards.
+	ops, _ := marshalCopies(t, st)
+	var checksums = make(map[string]string)
+	for _, op := range ops {
+		if src := op.GetSource(); src != nil && strings.HasPrefix(src.Identifier, "http") {
+			checksums[src.Identifier] = src.Attrs[pb.AttrHTTPChecksum]
+		}
+	}
+	require.Equal(t, map[string]string{
+		"http://archive.ubuntu.com/ubuntu/pool/universe/s/sl/sl_5.02-1_amd64.deb": "",
+		"http://archive.ubuntu.com/ubuntu/pool/main/c/curl/curl_8.5_amd64.deb":    "sha256:0123abcd",
+	}, checksums)
+	var mkfiles = fileMkfiles(ops)
+	require.Len(t, mkfiles, 1)
+	require.Equal(t, "4567cdef  /btidor.syntax/cache/archives/sl_5.02-1_amd64.deb\n", string(mkfiles[0].Data))
+	require.Equal(t, []string{"sha512sum --check --quiet /btidor.syntax/sha512sums"}, execScripts(ops))
+}
+
+func TestOnBuildPackageTriggers(t *testing.T) {
+	t.Parallel()
+	allDispatchStates := newDispatchStates()
+	mirror := &dispatchState{stage: instructions.Stage{Name: "apt-mirror"}, stageName: "apt-mirror"}
+	allDispatchStates.addState(mirror)
+
+	d := &dispatchState{
+		stage:     instructions.Stage{BaseName: "base", Location: []parser.Range{{Start: parser.Position{Line: 3}, End: parser.Position{Line: 3}}}},
+		stageName: "app",
+		deps:      make(map[*dispatchState]instructions.Command),
+		cmdTotal:  2, // FROM and a RUN in the stage itself
+	}
+	hasNewDeps, err := initOnBuildTriggers(d, []string{
+		"ADD --apt curl",
+		"ENV A=b",
+		"ADD --apt --mirror=apt-mirror sl",
+	}, allDispatchStates, shell.NewLex('\\'))
+	require.NoError(t, err)
+	require.True(t, hasNewDeps)
+
+	require.Len(t, d.commands, 3)
+	for _, cmd := range d.commands {
+		require.True(t, cmd.isOnBuild)
+		require.Equal(t, d.stage.Location, cmd.Location())
+	}
+	require.IsType(t, &instructions.PackageCommand{}, d.commands[0].Command)
+	require.Equal(t, []*dispatchState{mirror}, d.commands[2].sources)
+	require.Contains(t, d.deps, mirror)
+
+	cmd, err := toCommand(&instructions.PackageCommand{Mirror: "$MIRROR", PackageNames: []string{"sl"}},
+		allDispatchStates, shell.NewLex('\\'), shell.EnvsFromSlice([]string{"MIRROR=apt-mirror"}))
+	require.NoError(t, err)
+	require.Equal(t, []*dispatchState{mirror}, cmd.sources)
+	require.Equal(t, "apt-mirror", cmd.Command.(*instructions.PackageCommand).Mirror)
+	_, err = toCommand(&instructions.PackageCommand{From: "$UNSET", PackageNames: []string{"sl"}},
+		allDispatchStates, shell.NewLex('\\'), shell.EnvsFromSlice(nil))
+	require.ErrorContains(t, err, "empty --from value")
+	require.Equal(t, 2+2*PackageStepCount, d.cmdTotal)
+
+	d.cmdIndex = 1
+	d.cmdIsOnBuild = true
+	i := NewPackageInvocation(d, d.commands[0].Command.(*instructions.PackageCommand), nil, dispatchOpt{})
+	require.Equal(t, "[app 2/8] ONBUILD ADD (apt update) curl", i.updateStage)
+	require.Equal(t, "[app 4/8] ONBUILD ADD (apt install) curl", i.installStage)
+}
+
+func TestWithServicesDisabled(t *testing.T) {
+	t.Parallel()
+	var script = withServicesDisabled([]string{"apt-get install sl"})
+	require.Equal(t, []string{disableServicesScript, "apt-get install sl", enableServicesScript}, script)
+
+	// The scripts share variables, so they have to parse as a single script.
+	var cmd = exec.Command("sh", "-n", "-c", strings.Join(script, " && "))
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+}
+
+func TestDownloadFilesWithoutDigest(t *testing.T) {
+	t.Parallel()
+	var warnings []string
+	var files = []PackageDownload{{
+		uri:      "http://example.com/pool/s/sl/sl_5.02_amd64.deb",
+		filename: "sl_5.02_amd64.deb",
+		hashes:   map[string]string{"MD5SUM": "89ef"},
+	}}
+	i := &PackageInvocation{
+		d:   &dispatchState{stageName: "build"},
+		cmd: &instructions.PackageCommand{PackageNames: []string{"sl"}},
+		dopt: dispatchOpt{lint: linter.New(&linter.Config{
+			Warn: func(rulename, description, url, fmtmsg string, location []parser.Range) {
+				warnings = append(warnings, fmtmsg)
+			},
+		})},
+	}
+	_, err := i.DownloadFiles(llb.Scratch(), files, "/btidor.syntax/cache/archives/")
+	require.NoError(t, err)
+	require.Equal(t, []string{"Package sl_5.02_amd64.deb is downloaded without a verifiable digest"}, warnings)
+
+	i.dopt.buildArgValues = map[string]string{aptRequireDigest: "build"}
+	_, err = i.DownloadFiles(llb.Scratch(), files, "/btidor.syntax/cache/archives/")
+	require.ErrorContains(t, err, "package sl_5.02_amd64.deb has no SHA-256 or SHA-512 digest")
+}
+
+func TestUpgradePackages(t *testing.T) {
+	t.Parallel()
+	d := &dispatchState{cmdTotal: 3}
+	c := &instructions.PackageCommand{PackageNames: []string{}, Upgrade: true}
+	i := NewPackageInvocation(d, c, nil, dispatchOpt{})
+	require.Equal(t, "[1/3] ADD (apt update) --upgrade", i.updateStage)
+	require.Equal(t, "[3/3] ADD (apt install) --upgrade", i.installStage)
+	require.Equal(t, "dist-upgrade", i.aptAction())
+
+	c = &instructions.PackageCommand{PackageNames: []string{"sl"}}
+	require.Equal(t, "install", NewPackageInvocation(&dispatchState{}, c, nil, dispatchOpt{}).aptAction())
+
+	// On an image that's already up to date, there's nothing to download.
+	i = NewPackageInvocation(d, &instructions.PackageCommand{Upgrade: true}, nil, dispatchOpt{})
+	tmp := llb.Image("debian")
+	st, err := i.DownloadFiles(tmp, nil, "/btidor.syntax/cache/archives/")
+	require.NoError(t, err)
+	require.Equal(t, tmp.Output(), st.Output())
+	_, err = st.Marshal(context.TODO())
+	require.NoError(t, err)
+}
+
+func TestBuildDep(t *testing.T) {
+	t.Parallel()
+	d := &dispatchState{cmdTotal: 3}
+	c := &instructions.PackageCommand{PackageNames: []string{"hello", "src/debian/control"}, BuildDep: true}
+	i := NewPackageInvocation(d, c, nil, dispatchOpt{buildContext: llb.Local("context")})
+	require.Equal(t, "[3/3] ADD (apt install) --build-dep hello src/debian/control", i.installStage)
+	require.Equal(t, "build-dep", i.aptAction())
+	require.Equal(t, []string{"src/debian/control"}, i.contextFiles())
+	require.Equal(t, "hello /btidor.syntax/build-dep/1/", i.packageArgs())
+	require.Contains(t, i.aptOptions(), "Dir::Etc::SourceParts=/btidor.syntax/sources.list.d/")
+
+	tmp, err := i.CopyPackageFiles(llb.Scratch())
+	require.NoError(t, err)
+	_, copies := marshalCopies(t, tmp)
+	require.Len(t, copies, 1)
+	require.Equal(t, "/src/debian/control", copies[0].Src)
+	require.Equal(t, "/btidor.syntax/build-dep/1/debian/control", copies[0].Dest)
+
+	c = &instructions.PackageCommand{PackageNames: []string{"debian/control"}}
+	i = NewPackageInvocation(&dispatchState{}, c, nil, dispatchOpt{})
+	require.Empty(t, i.contextFiles())
+	require.Equal(t, "debian/control", i.packageArgs())
+	require.Equal(t, aptions, i.aptOptions())
+}
+
+func TestUnpackSource(t *testing.T) {
+	t.Parallel()
+	d := &dispatchState{
+		state:    llb.Image("debian").Dir("/work"),
+		platform: &ocispecs.Platform{OS: "linux", Architecture: "amd64"},
+		cmdTotal: 3,
+	}
+	c := &instructions.PackageCommand{PackageNames: []string{"hello"}, SourceDest: "src"}
+	i := NewPackageInvocation(d, c, nil, dispatchOpt{})
+	require.Equal(t, "[3/3] ADD (apt source) hello", i.installStage)
+	require.Equal(t, "source", i.aptAction())
+	require.False(t, i.installs())
+	require.True(t, i.rewritesSources())
+
+	require.NoError(t, i.CheckDpkgSource([]byte("/usr/bin/dpkg-source\n")))
+	require.ErrorContains(t, i.CheckDpkgSource(nil), "ADD --apt-source needs dpkg-source in the image")
+
+	require.NoError(t, i.UnpackSource(llb.Image("debian")))
+	require.Len(t, d.image.History, 1)
+	require.False(t, d.image.History[0].EmptyLayer)
+
+	ops, copies := marshalCopies(t, d.state)
+	var scripts = execScripts(ops)
+	require.Len(t, scripts, 1)
+	require.Contains(t, scripts[0], `[ -e "$f" ] || continue; dpkg-source --no-check -x "$f"`)
+	require.Len(t, copies, 1)
+	require.Equal(t, "/work/src", copies[0].Dest)
+}
+
+// marshalCopies marshals st and returns its ops, along with the copies among
+// their file actions.
+func marshalCopies(t *testing.T, st llb.State) ([]*pb.Op, []*pb.FileActionCopy) {
+	def, err := st.Marshal(context.TODO())
+	require.NoError(t, err)
+	var ops []*pb.Op
+	var copies []*pb.FileActionCopy
+	for _, dt := range def.Def {
+		var op pb.Op
+		require.NoError(t, op.UnmarshalVT(dt))
+		ops = append(ops, &op)
+		for _, action := range op.GetFile().GetActions() {
+			if cp := action.GetCopy(); cp != nil {
+				copies = append(copies, cp)
+			}
+		}
+	}
+	return ops, copies
+}
+
+// execScripts returns the shell script that each exec op runs.
+func execScripts(ops []*pb.Op) []string {
+	var scripts []string
+	for _, op := range ops {
+		if e := op.GetExec(); e != nil {
+			scripts = append(scripts, e.Meta.Args[len(e.Meta.Args)-1])
+		}
+	}
+	return scripts
+}
+
+// fileMkfiles returns the files created by the ops' file actions.
+func fileMkfiles(ops []*pb.Op) []*pb.FileActionMkFile {
+	var mkfiles []*pb.FileActionMkFile
+	for _, op := range ops {
+		for _, action := range op.GetFile().GetActions() {
+			if mk := action.GetMkfile(); mk != nil {
+				mkfiles = append(mkfiles, mk)
+			}
+		}
+	}
+	return mkfiles
+}
+
+func TestPackageFiles(t *testing.T) {
+	t.Parallel()
+	d := &dispatchState{cmdTotal: 3}
+	c := &instructions.PackageCommand{
+		PackageNames: []string{"vendor/tool_1.0_amd64.deb", "https://example.com/agent_2.1_all.deb", "sl"},
+		Checksum:     "sha256:" + strings.Repeat("0", 64),
+		Group:        "vendor",
+	}
+	i := NewPackageInvocation(d, c, nil, dispatchOpt{buildContext: llb.Local("context")})
+	require.Equal(t, []string{"vendor/tool_1.0_amd64.deb"}, i.contextFiles())
+	require.Equal(t, "/btidor.syntax/debs/0/tool_1.0_amd64.deb /btidor.syntax/debs/1/agent_2.1_all.deb sl",
+		i.packageArgs())
+
+	tmp, err := i.CopyPackageFiles(llb.Scratch())
+	require.NoError(t, err)
+	ops, copies := marshalCopies(t, tmp)
+	var httpSource *pb.SourceOp
+	for _, op := range ops {
+		if src := op.GetSource(); src != nil && strings.HasPrefix(src.Identifier, "https://") {
+			httpSource = src
+		}
+	}
+	require.NotNil(t, httpSource)
+	require.Equal(t, "https://example.com/agent_2.1_all.deb", httpSource.Identifier)
+	require.Equal(t, c.Checksum, httpSource.Attrs[pb.AttrHTTPChecksum])
+	require.Len(t, copies, 2)
+	require.Equal(t, "/btidor.syntax/debs/0/tool_1.0_amd64.deb", copies[0].Dest)
+	require.Equal(t, "/btidor.syntax/debs/1/agent_2.1_all.deb", copies[1].Dest)
+
+	c.Checksum = "sha256:nope"
+	_, err = i.CopyPackageFiles(llb.Scratch())
+	require.Error(t, err)
+
+	// apt prints the .deb files themselves, which aren't downloaded again.
+	uris, err := i.ParseURIs([]byte(`'file:/btidor.syntax/debs/0/tool_1.0_amd64.deb' vendor-tool_1.0-2_amd64.deb 644
+'http://deb.debian.org/debian/pool/main/s/sl/sl_5.02-1_amd64.deb' sl_5.02-1_amd64.deb 12980 SHA256:0123abcd
+`))
+	require.NoError(t, err)
+	require.Len(t, uris, 1)
+	require.Equal(t, "sl_5.02-1_amd64.deb", uris[0].filename)
+	uris, err = i.ParseURIs([]byte("'file:/btidor.syntax/debs/0/tool_1.0_amd64.deb' vendor-tool_1.0-2_amd64.deb 644\n"))
+	require.NoError(t, err)
+	require.Empty(t, uris)
+	tmp = llb.Image("debian")
+	st, err := i.DownloadFiles(tmp, uris, "/btidor.syntax/cache/archives/")
+	require.NoError(t, err)
+	require.Equal(t, tmp.Output(), st.Output())
+
+	// Packages are named after their control fields, not their filenames.
+	i.packageFiles = i.parsePackageFiles([]byte(`Filename: /btidor.syntax/debs/0/tool_1.0_amd64.deb
+SHA256: 0123abcd
+Package: vendor-tool
+Version: 1.0-2
+Architecture: amd64
+
+Filename: /btidor.syntax/debs/1/agent_2.1_all.deb
+SHA256: 4567ef01
+Package: agent
+Version: 2.1
+Architecture: all
+Source: agent-src
+
+`))
+	require.Equal(t, map[int]packageRecord{
+		0: {
+			PackageDownload: PackageDownload{filename: "tool_1.0_amd64.deb", hashes: map[string]string{"SHA256": "0123abcd"}},
+			name:            "vendor-tool", version: "1.0-2", arch: "amd64",
+		},
+		1: {
+			PackageDownload: PackageDownload{uri: "https://example.com/agent_2.1_all.deb",
+				filename: "agent_2.1_all.deb", hashes: map[string]string{"SHA256": "4567ef01"}},
+			name: "agent", version: "2.1", arch: "all",
+		},
+	}, i.packageFiles)
+	require.Equal(t, []string{"vendor-tool", "agent", "sl"}, i.requestedPackages())
+}
@@ -1,20 +1,43 @@
 package dockerfile2llb
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"maps"
+	"slices"
 	"sort"
+	"strings"
+	"text/tabwriter"
 
 	"github.com/btidor/syntax/dockerfile/instructions"
 	"github.com/moby/buildkit/frontend/dockerfile/parser"
+	"github.com/moby/buildkit/frontend/gateway/client"
 	"github.com/moby/buildkit/frontend/subrequests/outline"
 	pb "github.com/moby/buildkit/solver/pb"
 )
 
+// Outline extends the standard outline subrequest result with the packages
+// requested by `ADD --apt`.
+type Outline struct {
+	outline.Outline
+	Packages []OutlinePackage `json:"packages,omitempty"`
+}
+
+// OutlinePackage describes a single `ADD --apt` instruction.
+type OutlinePackage struct {
+	Stage    string       `json:"stage,omitempty"`
+	Manager  string       `json:"manager"`
+	Names    []string     `json:"names"`
+	Location *pb.Location `json:"location,omitempty"`
+}
+
 type outlineCapture struct {
 	allArgs  map[string]argInfo
 	usedArgs map[string]struct{}
 	secrets  map[string]secretInfo
 	ssh      map[string]sshInfo
+	packages []packageInfo
 }
 
 type argInfo struct {
@@ -34,6 +57,13 @@ type sshInfo struct {
 	location []parser.Range
 }
 
+type packageInfo struct {
+	stage    string
+	manager  string
+	names    []string
+	location []parser.Range
+}
+
 func newOutlineCapture() outlineCapture {
 	return outlineCapture{
 		allArgs:  map[string]argInfo{},
@@ -49,6 +79,7 @@ func (o outlineCapture) clone() outlineCapture {
 		usedArgs: maps.Clone(o.usedArgs),
 		secrets:  maps.Clone(o.secrets),
 		ssh:      maps.Clone(o.ssh),
+		packages: slices.Clone(o.packages),
 	}
 }
 
@@ -135,7 +166,31 @@ func (ds *dispatchState) ssh(visited map[string]struct{}) []outline.SSH {
 	return ssh
 }
 
-func (ds *dispatchState) Outline(dt []byte) outline.Outline {
+func (ds *dispatchState) outlinePackages(visited map[*dispatchState]struct{}) []OutlinePackage {
+	if _, ok := visited[ds]; ok {
+		return nil
+	}
+	visited[ds] = struct{}{}
+
+	packages := make([]OutlinePackage, 0, len(ds.outline.packages))
+	for _, p := range ds.outline.packages {
+		packages = append(packages, OutlinePackage{
+			Stage:    p.stage,
+			Manager:  p.manager,
+			Names:    p.names,
+			Location: toSourceLocation(p.location),
+		})
+	}
+	if ds.base != nil {
+		packages = append(packages, ds.base.outlinePackages(visited)...)
+	}
+	for d := range ds.deps {
+		packages = append(packages, d.outlinePackages(visited)...)
+	}
+	return packages
+}
+
+func (ds *dispatchState) Outline(dt []byte) Outline {
 	args := ds.args(map[string]struct{}{})
 	sort.Slice(args, func(i, j int) bool {
 		return compLocation(args[i].Location, args[j].Location)
@@ -151,18 +206,54 @@ func (ds *dispatchState) Outline(dt []byte) outline.Outline {
 		return compLocation(ssh[i].Location, ssh[j].Location)
 	})
 
-	out := outline.Outline{
-		Name:        ds.stage.Name,
-		Description: ds.stage.DocComment,
-		Sources:     [][]byte{dt},
-		Args:        args,
-		Secrets:     secrets,
-		SSH:         ssh,
+	packages := ds.outlinePackages(map[*dispatchState]struct{}{})
+	sort.Slice(packages, func(i, j int) bool {
+		return compLocation(packages[i].Location, packages[j].Location)
+	})
+
+	out := Outline{
+		Outline: outline.Outline{
+			Name:        ds.stage.Name,
+			Description: ds.stage.DocComment,
+			Sources:     [][]byte{dt},
+			Args:        args,
+			Secrets:     secrets,
+			SSH:         ssh,
+		},
+		Packages: packages,
 	}
 
 	return out
 }
 
+// ToResult is like `outline.Outline.ToResult()`, but includes packages.
+func (o Outline) ToResult() (*client.Result, error) {
+	res := client.NewResult()
+	dt, err := json.MarshalIndent(o, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	res.AddMeta("result.json", dt)
+
+	b := bytes.NewBuffer(nil)
+	if err := outline.PrintOutline(dt, b); err != nil {
+		return nil, err
+	}
+	if len(o.Packages) > 0 {
+		tw := tabwriter.NewWriter(b, 0, 0, 3, ' ', 0)
+		fmt.Fprintf(tw, "PACKAGES\tSTAGE\tMANAGER\n")
+		for _, p := range o.Packages {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", strings.Join(p.Names, " "), p.Stage, p.Manager)
+		}
+		tw.Flush()
+		fmt.Fprintln(tw)
+	}
+	res.AddMeta("result.txt", b.Bytes())
+
+	res.AddMeta("version", []byte(outline.SubrequestsOutlineDefinition.Version))
+	return res, nil
+}
+
 func toSourceLocation(r []parser.Range) *pb.Location {
 	if len(r) == 0 {
 		return nil
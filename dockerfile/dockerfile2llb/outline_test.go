@@ -0,0 +1,47 @@
+package dockerfile2llb
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/moby/buildkit/frontend/dockerui"
+	"github.com/moby/buildkit/util/appcontext"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutlinePackages(t *testing.T) {
+	t.Parallel()
+	df := `ARG TOOLS="clang make"
+FROM scratch AS base
+ADD --apt ca-certificates
+
+FROM base AS build
+ARG TOOLS
+ADD --apt $TOOLS sl
+
+FROM scratch AS unused
+ADD --apt nginx
+`
+	o, err := Dockerfile2Outline(appcontext.Context(), []byte(df), ConvertOpt{
+		Config: dockerui.Config{Target: "build"},
+	})
+	require.NoError(t, err)
+	require.Len(t, o.Packages, 2)
+
+	require.Equal(t, "base", o.Packages[0].Stage)
+	require.Equal(t, "apt", o.Packages[0].Manager)
+	require.Equal(t, []string{"ca-certificates"}, o.Packages[0].Names)
+	require.Equal(t, int32(3), o.Packages[0].Location.Ranges[0].Start.Line)
+
+	require.Equal(t, "build", o.Packages[1].Stage)
+	require.Equal(t, []string{"clang", "make", "sl"}, o.Packages[1].Names)
+	require.Equal(t, int32(7), o.Packages[1].Location.Ranges[0].Start.Line)
+
+	res, err := o.ToResult()
+	require.NoError(t, err)
+	var parsed map[string]any
+	require.NoError(t, json.Unmarshal(res.Metadata["result.json"], &parsed))
+	require.Equal(t, "build", parsed["name"])
+	require.Len(t, parsed["packages"], 2)
+	require.Contains(t, string(res.Metadata["result.txt"]), "clang make sl")
+}
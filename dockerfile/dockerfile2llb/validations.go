@@ -1,6 +1,7 @@
 package dockerfile2llb
 
 import (
+	"path"
 	"path/filepath"
 	"regexp"
 	"runtime"
@@ -339,3 +340,88 @@ func validateBaseImagesWithDefaultArgs(stages []instructions.Stage, shlex *shell
 		}
 	}
 }
+
+// validatePackageManagerUsage inspects RUN instructions for apt usage that
+// could be written with ADD --apt or that's likely to misbehave.
+func validatePackageManagerUsage(stages []instructions.Stage, lint *linter.Linter) {
+	for _, stage := range stages {
+		// The most recent RUN in the stage that updated the package lists
+		// without installing anything.
+		var updateOnly *instructions.RunCommand
+		for _, cmd := range stage.Commands {
+			run, ok := cmd.(*instructions.RunCommand)
+			if !ok {
+				continue
+			}
+			cmdLint := lint.WithMergedConfigFromComments(run.Comments())
+
+			cmds, _ := runCommands(run)
+			var hasUpdate, hasInstall, removesLists, removesDockerClean bool
+			for _, sc := range cmds {
+				if removesPath(sc.words, "/var/lib/apt/lists") {
+					removesLists = true
+				}
+				if removesPath(sc.words, "/etc/apt/apt.conf.d/docker-clean") {
+					removesDockerClean = true
+				}
+				apt, ok := parseAptCommand(sc.words)
+				if !ok {
+					continue
+				}
+				if apt.tool == "apt" && apt.action != "" {
+					msg := linter.RuleAptInScript.Format(apt.action)
+					cmdLint.Run(&linter.RuleAptInScript, run.Location(), msg)
+				}
+				switch apt.action {
+				case "update":
+					hasUpdate = true
+				case "install":
+					hasInstall = true
+					if apt.tool == "apt-get" && apt.isPlainInstall() {
+						msg := linter.RuleAptGetInstallInRun.Format(strings.Join(apt.args, " "))
+						cmdLint.Run(&linter.RuleAptGetInstallInRun, run.Location(), msg)
+					}
+				}
+			}
+
+			// The stage's variables aren't known yet, so mounts are parsed
+			// with their values as written.
+			mounts, _ := instructions.ParseMounts(run, func(word string) (string, error) { return word, nil })
+			var listsCached bool
+			var sharedCache string
+			for _, m := range mounts {
+				if m.Type != instructions.MountTypeCache {
+					continue
+				}
+				target := path.Clean(m.Target)
+				if target == "/var/lib/apt" || target == "/var/lib/apt/lists" {
+					listsCached = true
+				}
+				if strings.HasPrefix(target+"/", "/var/cache/apt/") || target == "/var/cache" {
+					if m.CacheSharing == "" || m.CacheSharing == instructions.MountSharingShared {
+						sharedCache = m.Target
+					}
+				}
+			}
+
+			if hasInstall {
+				if !hasUpdate && updateOnly != nil {
+					updateLint := lint.WithMergedConfigFromComments(updateOnly.Comments())
+					msg := linter.RuleAptUpdateInSeparateRun.Format()
+					updateLint.Run(&linter.RuleAptUpdateInSeparateRun, updateOnly.Location(), msg)
+				}
+				updateOnly = nil
+				if !removesLists && !listsCached {
+					msg := linter.RuleAptListsNotRemoved.Format()
+					cmdLint.Run(&linter.RuleAptListsNotRemoved, run.Location(), msg)
+				}
+			} else if hasUpdate {
+				updateOnly = run
+			}
+			if removesDockerClean && sharedCache != "" {
+				msg := linter.RuleAptDockerCleanShared.Format(sharedCache)
+				cmdLint.Run(&linter.RuleAptDockerCleanShared, run.Location(), msg)
+			}
+		}
+	}
+}
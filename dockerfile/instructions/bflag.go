@@ -14,6 +14,7 @@ const (
 	boolType FlagType = iota
 	stringType
 	stringsType
+	optionalStringType
 )
 
 // BFlags contains all flags information for the builder
@@ -31,6 +32,7 @@ type Flag struct {
 	flagType     FlagType
 	Value        string
 	StringValues []string
+	implicit     string // value of an optional string flag given without "="
 }
 
 // NewBFlags returns the new BFlags struct
@@ -74,6 +76,19 @@ func (bf *BFlags) AddString(name string, def string) *Flag {
 	return flag
 }
 
+// AddOptionalString adds a string flag to BFlags whose value can be omitted,
+// in which case it's set to implicit.
+// Note, any error will be generated when Parse() is called (see Parse).
+func (bf *BFlags) AddOptionalString(name string, def string, implicit string) *Flag {
+	flag := bf.addFlag(name, optionalStringType)
+	if flag == nil {
+		return nil
+	}
+	flag.Value = def
+	flag.implicit = implicit
+	return flag
+}
+
 // AddStrings adds a string flag to BFlags that can match multiple values
 func (bf *BFlags) AddStrings(name string) *Flag {
 	flag := bf.addFlag(name, stringsType)
@@ -199,6 +214,15 @@ func (bf *BFlags) Parse() error {
 			}
 			flag.Value = value
 
+		case optionalStringType:
+			if !hasValue {
+				flag.Value = flag.implicit
+			} else if value == "" {
+				return errors.Errorf("missing a value on flag: %s", flagName)
+			} else {
+				flag.Value = value
+			}
+
 		case stringsType:
 			if !hasValue {
 				return errors.Errorf("missing a value on flag: %s", flagName)
@@ -213,3 +213,33 @@ func TestBuilderFlags(t *testing.T) {
 		t.Fatalf("Test %s, expected '%s', got '%s'", bf.Args, expected, actual)
 	}
 }
+
+func TestBuilderFlagsOptionalString(t *testing.T) {
+	for _, tc := range []struct {
+		args     []string
+		expected string
+		used     bool
+	}{
+		{args: []string{}, expected: "default"},
+		{args: []string{"--opt"}, expected: "implicit", used: true},
+		{args: []string{"--opt=explicit"}, expected: "explicit", used: true},
+	} {
+		bf := NewBFlagsWithArgs(tc.args)
+		fl := bf.AddOptionalString("opt", "default", "implicit")
+		if err := bf.Parse(); err != nil {
+			t.Fatalf("Parse of %q was supposed to work: %s", tc.args, err)
+		}
+		if fl.Value != tc.expected {
+			t.Fatalf("Parse of %q: expected %q, got %q", tc.args, tc.expected, fl.Value)
+		}
+		if fl.IsUsed() != tc.used {
+			t.Fatalf("Parse of %q: expected used=%v", tc.args, tc.used)
+		}
+	}
+
+	bf := NewBFlagsWithArgs([]string{"--opt="})
+	bf.AddOptionalString("opt", "", "implicit")
+	if err := bf.Parse(); err == nil {
+		t.Fatalf("Parse of %q was supposed to fail", bf.Args)
+	}
+}
@@ -284,10 +284,155 @@ func (c *AddCommand) Expand(expander SingleWordExpander) error {
 
 // PackageCommand installs the given packages using the system package manager.
 //
-// ADD --apt foo bar
+//	ADD --apt foo bar
+//	ADD --apt --mirror=apt-mirror foo bar
+//	ADD --apt --download-only=/repo --index foo bar
+//	ADD --apt --from=debian --root=/ --dpkg-status foo bar
+//	ADD --apt --link foo bar
+//	ADD --apt --group=build-deps foo bar
+//	ADD --apt --remove=build-deps
+//	ADD --apt --debconf=selections.conf foo bar
+//	ADD --apt foo bar <<EOF
+//	ADD --apt --keep-lists foo bar
+//	ADD --apt --slim=doc,man foo bar
+//	ADD --apt --allow-remove --allow-downgrade foo bar
+//	ADD --apt --max-download-size=200MiB foo bar
+//	ADD --apt --upgrade [foo bar]
+//	ADD --apt --build-dep foo debian/control
+//	ADD --apt-source foo bar /src
+//	ADD --apt --checksum=sha256:... ./vendor.deb https://example.com/tool.deb
 type PackageCommand struct {
 	withNameAndCode
 	PackageNames []string
+	Mirror       string   // stage or named context containing a repository tree
+	DownloadOnly string   // export the downloaded packages here instead of installing
+	Index        bool     // generate a flat repository index for DownloadOnly
+	Root         string   // unpack the packages into this directory instead of installing
+	From         string   // stage or image whose apt resolves packages for Root
+	DpkgStatus   bool     // write a dpkg status file describing the packages in Root
+	Link         bool     // compute the package layer independently of the stage's earlier layers
+	Group        string   // record the packages as members of this group
+	Remove       string   // purge the members of this group instead of installing
+	Debconf      string   // build context file with debconf selections
+	KeepLists    bool     // leave the package lists in the image
+	Slim         []string // kinds of files to leave out of the image, see PackageSlimCategories
+
+	AllowRemove    bool   // let apt remove installed packages to satisfy the request
+	AllowDowngrade bool   // let apt downgrade installed packages to satisfy the request
+	Upgrade        bool   // upgrade all installed packages, along with installing any named ones
+	BuildDep       bool   // install the build dependencies of source packages or debian/control files
+	Checksum       string // digest of the one .deb URL among PackageNames
+
+	// SourceDest is set for `ADD --apt-source`, which unpacks the named source
+	// packages into this directory instead of installing anything.
+	SourceDest string
+
+	// MaxDownloadSize fails the build if the packages to download add up to
+	// more than this size, e.g. "200MiB".
+	MaxDownloadSize string
+
+	// DebconfHeredocs holds debconf selections given inline as heredocs.
+	DebconfHeredocs []string
+}
+
+// IsPackageFile reports whether a package name given to `ADD --apt` is a
+// .deb file, either a path in the build context or a URL.
+func IsPackageFile(name string) bool {
+	return strings.HasSuffix(name, ".deb")
+}
+
+// IsPackageURL reports whether a package name given to `ADD --apt` is the URL
+// of a .deb file.
+func IsPackageURL(name string) bool {
+	return IsPackageFile(name) && (strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://"))
+}
+
+// PackageSlimCategories are the kinds of files that `ADD --apt --slim` can
+// leave out of the image. A bare `--slim` selects all of them.
+var PackageSlimCategories = []string{"doc", "man", "locale"}
+
+// NewPackageCommandFromRun returns a PackageCommand that installs packages in
+// place of a RUN instruction, keeping its source code, location and comments.
+func NewPackageCommandFromRun(run *RunCommand, packages []string) *PackageCommand {
+	return &PackageCommand{
+		withNameAndCode: run.withNameAndCode,
+		PackageNames:    packages,
+	}
+}
+
+// Expand variables. A variable that expands to several words, such as
+// `ADD --apt $PACKAGES`, contributes each word as a separate package.
+func (c *PackageCommand) Expand(expander SingleWordExpander) error {
+	var names []string
+	for _, name := range c.PackageNames {
+		expanded, err := expander(name)
+		if err != nil {
+			return err
+		}
+		names = append(names, strings.Fields(expanded)...)
+	}
+	c.PackageNames = names
+
+	expandedMirror, err := expander(c.Mirror)
+	if err != nil {
+		return err
+	}
+	c.Mirror = expandedMirror
+
+	expandedFrom, err := expander(c.From)
+	if err != nil {
+		return err
+	}
+	c.From = expandedFrom
+
+	expandedDownloadOnly, err := expander(c.DownloadOnly)
+	if err != nil {
+		return err
+	}
+	c.DownloadOnly = expandedDownloadOnly
+
+	expandedRoot, err := expander(c.Root)
+	if err != nil {
+		return err
+	}
+	c.Root = expandedRoot
+
+	expandedGroup, err := expander(c.Group)
+	if err != nil {
+		return err
+	}
+	c.Group = expandedGroup
+
+	expandedRemove, err := expander(c.Remove)
+	if err != nil {
+		return err
+	}
+	c.Remove = expandedRemove
+
+	expandedDebconf, err := expander(c.Debconf)
+	if err != nil {
+		return err
+	}
+	c.Debconf = expandedDebconf
+
+	expandedMaxDownloadSize, err := expander(c.MaxDownloadSize)
+	if err != nil {
+		return err
+	}
+	c.MaxDownloadSize = expandedMaxDownloadSize
+
+	expandedChecksum, err := expander(c.Checksum)
+	if err != nil {
+		return err
+	}
+	c.Checksum = expandedChecksum
+
+	expandedSourceDest, err := expander(c.SourceDest)
+	if err != nil {
+		return err
+	}
+	c.SourceDest = expandedSourceDest
+	return nil
 }
 
 // CopyCommand copies files from the provided sources to the target destination.
@@ -83,13 +83,9 @@ func setMountState(cmd *RunCommand, expander SingleWordExpander) error {
 	if st == nil {
 		return errors.Errorf("no mount state")
 	}
-	mounts := make([]*Mount, len(st.flag.StringValues))
-	for i, str := range st.flag.StringValues {
-		m, err := parseMount(str, expander)
-		if err != nil {
-			return err
-		}
-		mounts[i] = m
+	mounts, err := ParseMounts(cmd, expander)
+	if err != nil {
+		return err
 	}
 	st.mounts = mounts
 	return nil
@@ -107,6 +103,25 @@ func GetMounts(cmd *RunCommand) []*Mount {
 	return getMountState(cmd).mounts
 }
 
+// ParseMounts parses the command's mounts with expander, without changing the
+// mounts it's dispatched with. Until the command is expanded, GetMounts only
+// has the `from` of each mount.
+func ParseMounts(cmd *RunCommand, expander SingleWordExpander) ([]*Mount, error) {
+	st := getMountState(cmd)
+	if st == nil {
+		return nil, errors.Errorf("no mount state")
+	}
+	mounts := make([]*Mount, len(st.flag.StringValues))
+	for i, str := range st.flag.StringValues {
+		m, err := parseMount(str, expander)
+		if err != nil {
+			return nil, err
+		}
+		mounts[i] = m
+	}
+	return mounts, nil
+}
+
 type mountState struct {
 	flag   *Flag
 	mounts []*Mount
@@ -322,16 +322,138 @@ func parseAdd(req parseRequest) (interface{}, error) {
 	flUnpack := req.flags.AddBool("unpack", false)
 	flExcludes := req.flags.AddStrings("exclude")
 	flApt := req.flags.AddBool("apt", false)
+	flMirror := req.flags.AddString("mirror", "")
+	flDownloadOnly := req.flags.AddString("download-only", "")
+	flIndex := req.flags.AddBool("index", false)
+	flRoot := req.flags.AddString("root", "")
+	flFrom := req.flags.AddString("from", "")
+	flDpkgStatus := req.flags.AddBool("dpkg-status", false)
+	flGroup := req.flags.AddString("group", "")
+	flRemove := req.flags.AddString("remove", "")
+	flDebconf := req.flags.AddString("debconf", "")
+	flKeepLists := req.flags.AddBool("keep-lists", false)
+	flSlim := req.flags.AddOptionalString("slim", "", strings.Join(PackageSlimCategories, ","))
+	flAllowRemove := req.flags.AddBool("allow-remove", false)
+	flAllowDowngrade := req.flags.AddBool("allow-downgrade", false)
+	flMaxDownloadSize := req.flags.AddString("max-download-size", "")
+	flUpgrade := req.flags.AddBool("upgrade", false)
+	flBuildDep := req.flags.AddBool("build-dep", false)
+	flAptSource := req.flags.AddBool("apt-source", false)
 	if err := req.flags.Parse(); err != nil {
 		return nil, err
 	}
 
+	if flAptSource.Value == "true" {
+		err := errPackageFlagConflict(flAptSource, flApt, flDownloadOnly, flIndex, flRoot, flFrom,
+			flDpkgStatus, flGroup, flRemove, flDebconf, flKeepLists, flSlim, flAllowRemove,
+			flAllowDowngrade, flUpgrade, flBuildDep)
+		if err != nil {
+			return nil, err
+		}
+		if len(req.args) < 2 {
+			return nil, errNoDestinationArgument("ADD")
+		}
+		return &PackageCommand{
+			withNameAndCode: newWithNameAndCode(req),
+			PackageNames:    slices.Clone(req.args[:len(req.args)-1]),
+			SourceDest:      req.args[len(req.args)-1],
+			Mirror:          flMirror.Value,
+			Link:            flLink.Value == "true",
+			MaxDownloadSize: flMaxDownloadSize.Value,
+		}, nil
+	}
 	if flApt.Value == "true" {
+		if flRemove.Value != "" && len(req.args) > 0 {
+			return nil, errors.New("ADD --apt --remove doesn't take package names")
+		}
+		if flIndex.IsUsed() && flDownloadOnly.Value == "" {
+			return nil, errPackageFlagRequires("index", "download-only")
+		}
+		for _, fl := range []*Flag{flFrom, flDpkgStatus} {
+			if fl.IsUsed() && flRoot.Value == "" {
+				return nil, errPackageFlagRequires(fl.name, "root")
+			}
+		}
+		for _, conflict := range [][]*Flag{
+			{flRemove, flMirror, flDownloadOnly, flRoot, flGroup, flKeepLists, flSlim, flAllowRemove, flAllowDowngrade, flMaxDownloadSize, flUpgrade, flBuildDep},
+			{flRoot, flDownloadOnly},
+			{flGroup, flDownloadOnly, flRoot},
+			{flKeepLists, flDownloadOnly, flRoot, flMirror},
+			{flSlim, flDownloadOnly, flRoot},
+			{flAllowRemove, flDownloadOnly, flRoot},
+			{flAllowDowngrade, flDownloadOnly, flRoot},
+			{flUpgrade, flRoot},
+			{flBuildDep, flRoot, flUpgrade, flGroup},
+		} {
+			if err := errPackageFlagConflict(conflict[0], conflict[1:]...); err != nil {
+				return nil, err
+			}
+		}
+		var slim []string
+		if flSlim.IsUsed() {
+			for _, category := range strings.Split(flSlim.Value, ",") {
+				category = strings.TrimSpace(category)
+				if !slices.Contains(PackageSlimCategories, category) {
+					err := errors.Errorf("unknown --slim category %q", category)
+					return nil, suggest.WrapError(err, category, PackageSlimCategories, true)
+				}
+				slim = append(slim, category)
+			}
+		}
+		names, selections := parsePackageHeredocs(req)
+		var remoteDebs int
+		for _, name := range names {
+			if !IsPackageFile(name) {
+				continue
+			}
+			if IsPackageURL(name) {
+				remoteDebs++
+			}
+			for _, fl := range []*Flag{flDownloadOnly, flRoot} {
+				if fl.IsUsed() {
+					return nil, errors.Errorf("ADD --apt with .deb files can't be used together with --%s", fl.name)
+				}
+			}
+		}
+		if flChecksum.Value != "" && remoteDebs != 1 {
+			return nil, errors.New("ADD --apt --checksum needs exactly one .deb URL")
+		}
+		if flDebconf.Value != "" || len(selections) > 0 {
+			for _, fl := range []*Flag{flDownloadOnly, flRoot} {
+				if fl.IsUsed() {
+					return nil, errors.Errorf("ADD --debconf and --%s can't be used together", fl.name)
+				}
+			}
+		}
 		return &PackageCommand{
 			withNameAndCode: newWithNameAndCode(req),
-			PackageNames:    req.args,
+			PackageNames:    names,
+			Mirror:          flMirror.Value,
+			DownloadOnly:    flDownloadOnly.Value,
+			Index:           flIndex.Value == "true",
+			Root:            flRoot.Value,
+			From:            flFrom.Value,
+			DpkgStatus:      flDpkgStatus.Value == "true",
+			Link:            flLink.Value == "true",
+			Group:           flGroup.Value,
+			Remove:          flRemove.Value,
+			Debconf:         flDebconf.Value,
+			DebconfHeredocs: selections,
+			KeepLists:       flKeepLists.Value == "true",
+			Slim:            slim,
+			AllowRemove:     flAllowRemove.Value == "true",
+			AllowDowngrade:  flAllowDowngrade.Value == "true",
+			MaxDownloadSize: flMaxDownloadSize.Value,
+			Upgrade:         flUpgrade.Value == "true",
+			BuildDep:        flBuildDep.Value == "true",
+			Checksum:        flChecksum.Value,
 		}, nil
 	}
+	for _, fl := range []*Flag{flMirror, flDownloadOnly, flIndex, flRoot, flFrom, flDpkgStatus, flGroup, flRemove, flDebconf, flKeepLists, flSlim, flAllowRemove, flAllowDowngrade, flMaxDownloadSize, flUpgrade, flBuildDep} {
+		if fl.IsUsed() {
+			return nil, errPackageFlagWithoutApt(fl.name)
+		}
+	}
 
 	if len(req.args) < 2 {
 		return nil, errNoDestinationArgument("ADD")
@@ -542,6 +664,30 @@ func parseRun(req parseRequest) (*RunCommand, error) {
 	return cmd, nil
 }
 
+// parsePackageHeredocs separates the package names of an `ADD --apt` command
+// from its heredocs, which contain debconf selections.
+func parsePackageHeredocs(req parseRequest) ([]string, []string) {
+	heredocLookup := make(map[string]parser.Heredoc)
+	for _, heredoc := range req.heredocs {
+		heredocLookup[heredoc.Name] = heredoc
+	}
+
+	names := []string{}
+	var selections []string
+	for _, arg := range req.args {
+		if heredoc := parser.MustParseHeredoc(arg); heredoc != nil {
+			content := heredocLookup[heredoc.Name].Content
+			if heredoc.Chomp {
+				content = parser.ChompHeredocContent(content)
+			}
+			selections = append(selections, content)
+		} else {
+			names = append(names, arg)
+		}
+	}
+	return names, selections
+}
+
 func parseCmd(req parseRequest) (*CmdCommand, error) {
 	if err := req.flags.Parse(); err != nil {
 		return nil, err
@@ -826,6 +972,26 @@ func errBadHeredoc(command string, option string) error {
 	return errors.Errorf("%s cannot accept a heredoc as %s", command, option)
 }
 
+func errPackageFlagWithoutApt(flag string) error {
+	return errPackageFlagRequires(flag, "apt")
+}
+
+func errPackageFlagRequires(flag, other string) error {
+	return errors.Errorf("ADD --%s can only be used together with --%s", flag, other)
+}
+
+func errPackageFlagConflict(flag *Flag, others ...*Flag) error {
+	if !flag.IsUsed() {
+		return nil
+	}
+	for _, other := range others {
+		if other.IsUsed() {
+			return errors.Errorf("ADD --%s and --%s can't be used together", flag.name, other.name)
+		}
+	}
+	return nil
+}
+
 func errBlankCommandNames(command string) error {
 	return errors.Errorf("%s names can not be blank", command)
 }
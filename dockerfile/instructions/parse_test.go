@@ -2,6 +2,7 @@ package instructions
 
 import (
 	"bytes"
+	"os"
 	"strings"
 	"testing"
 
@@ -235,6 +236,81 @@ func TestErrorCases(t *testing.T) {
 			dockerfile:    `ONBUILD ONBUILD RUN touch foobar`,
 			expectedError: "Chaining ONBUILD via `ONBUILD ONBUILD` isn't allowed",
 		},
+		{
+			name:          "ADD package flag without --apt",
+			dockerfile:    `ADD --mirror=apt-mirror foo /bar`,
+			expectedError: "ADD --mirror can only be used together with --apt",
+		},
+		{
+			name:          "ADD --index without --download-only",
+			dockerfile:    `ADD --apt --index foo`,
+			expectedError: "ADD --index can only be used together with --download-only",
+		},
+		{
+			name:          "ADD --from without --root",
+			dockerfile:    `ADD --apt --from=debian foo`,
+			expectedError: "ADD --from can only be used together with --root",
+		},
+		{
+			name:          "ADD --root with --download-only",
+			dockerfile:    `ADD --apt --root=/out --download-only=/repo foo`,
+			expectedError: "ADD --root and --download-only can't be used together",
+		},
+		{
+			name:          "ADD --remove with package names",
+			dockerfile:    `ADD --apt --remove=build-deps gcc`,
+			expectedError: "ADD --apt --remove doesn't take package names",
+		},
+		{
+			name:          "ADD --remove with --group",
+			dockerfile:    `ADD --apt --remove=build-deps --group=other`,
+			expectedError: "ADD --remove and --group can't be used together",
+		},
+		{
+			name:          "ADD --slim with unknown category",
+			dockerfile:    `ADD --apt --slim=docs foo`,
+			expectedError: `unknown --slim category "docs"`,
+		},
+		{
+			name:          "ADD --apt --checksum without .deb URL",
+			dockerfile:    `ADD --apt --checksum=sha256:0123 ./vendor.deb sl`,
+			expectedError: "ADD --apt --checksum needs exactly one .deb URL",
+		},
+		{
+			name:          "ADD --apt .deb with --root",
+			dockerfile:    `ADD --apt --root=/sysroot ./vendor.deb`,
+			expectedError: "ADD --apt with .deb files can't be used together with --root",
+		},
+		{
+			name:          "ADD --apt-source with --apt",
+			dockerfile:    `ADD --apt --apt-source hello /src`,
+			expectedError: "ADD --apt-source and --apt can't be used together",
+		},
+		{
+			name:          "ADD --apt-source without destination",
+			dockerfile:    `ADD --apt-source hello`,
+			expectedError: "ADD requires at least two arguments",
+		},
+		{
+			name:          "ADD --build-dep with --group",
+			dockerfile:    `ADD --apt --build-dep --group=deps foo`,
+			expectedError: "ADD --build-dep and --group can't be used together",
+		},
+		{
+			name:          "ADD --upgrade with --root",
+			dockerfile:    `ADD --apt --upgrade --root=/sysroot foo`,
+			expectedError: "ADD --upgrade and --root can't be used together",
+		},
+		{
+			name:          "ADD --allow-downgrade with --download-only",
+			dockerfile:    `ADD --apt --allow-downgrade --download-only=/repo foo`,
+			expectedError: "ADD --allow-downgrade and --download-only can't be used together",
+		},
+		{
+			name:          "ADD --keep-lists with --mirror",
+			dockerfile:    `ADD --apt --keep-lists --mirror=apt-mirror foo`,
+			expectedError: "ADD --keep-lists and --mirror can't be used together",
+		},
 		{
 			name:          "Invalid instruction",
 			dockerfile:    `FOO bar`,
@@ -272,6 +348,142 @@ func TestRunCmdFlagsUsed(t *testing.T) {
 	require.Equal(t, []string{"mount"}, c.(*RunCommand).FlagsUsed)
 }
 
+func TestPackageCmd(t *testing.T) {
+	cases := []struct {
+		dockerfile string
+		expected   PackageCommand
+	}{
+		{
+			dockerfile: "ADD --apt clang nginx",
+			expected:   PackageCommand{PackageNames: []string{"clang", "nginx"}},
+		},
+		{
+			dockerfile: "ADD --apt --mirror=apt-mirror sl",
+			expected:   PackageCommand{PackageNames: []string{"sl"}, Mirror: "apt-mirror"},
+		},
+		{
+			dockerfile: "ADD --apt --download-only=/repo --index sl",
+			expected:   PackageCommand{PackageNames: []string{"sl"}, DownloadOnly: "/repo", Index: true},
+		},
+		{
+			dockerfile: "ADD --apt --from=debian --root=/ --dpkg-status libssl3",
+			expected:   PackageCommand{PackageNames: []string{"libssl3"}, Root: "/", From: "debian", DpkgStatus: true},
+		},
+		{
+			dockerfile: "ADD --apt --link sl",
+			expected:   PackageCommand{PackageNames: []string{"sl"}, Link: true},
+		},
+		{
+			dockerfile: "ADD --apt --checksum=sha256:0123 ./vendor.deb https://example.com/tool.deb sl",
+			expected: PackageCommand{
+				PackageNames: []string{"./vendor.deb", "https://example.com/tool.deb", "sl"},
+				Checksum:     "sha256:0123",
+			},
+		},
+		{
+			dockerfile: "ADD --apt-source --mirror=apt-mirror hello sl /src",
+			expected:   PackageCommand{PackageNames: []string{"hello", "sl"}, SourceDest: "/src", Mirror: "apt-mirror"},
+		},
+		{
+			dockerfile: "ADD --apt --build-dep hello debian/control",
+			expected:   PackageCommand{PackageNames: []string{"hello", "debian/control"}, BuildDep: true},
+		},
+		{
+			dockerfile: "ADD --apt --upgrade",
+			expected:   PackageCommand{PackageNames: []string{}, Upgrade: true},
+		},
+		{
+			dockerfile: "ADD --apt --upgrade sl",
+			expected:   PackageCommand{PackageNames: []string{"sl"}, Upgrade: true},
+		},
+		{
+			dockerfile: "ADD --apt --max-download-size=200MiB sl",
+			expected:   PackageCommand{PackageNames: []string{"sl"}, MaxDownloadSize: "200MiB"},
+		},
+		{
+			dockerfile: "ADD --apt --allow-remove --allow-downgrade sl",
+			expected:   PackageCommand{PackageNames: []string{"sl"}, AllowRemove: true, AllowDowngrade: true},
+		},
+		{
+			dockerfile: "ADD --apt --keep-lists sl",
+			expected:   PackageCommand{PackageNames: []string{"sl"}, KeepLists: true},
+		},
+		{
+			dockerfile: "ADD --apt --slim sl",
+			expected:   PackageCommand{PackageNames: []string{"sl"}, Slim: []string{"doc", "man", "locale"}},
+		},
+		{
+			dockerfile: "ADD --apt --slim=doc,man sl",
+			expected:   PackageCommand{PackageNames: []string{"sl"}, Slim: []string{"doc", "man"}},
+		},
+		{
+			dockerfile: "ADD --apt --group=build-deps gcc make",
+			expected:   PackageCommand{PackageNames: []string{"gcc", "make"}, Group: "build-deps"},
+		},
+		{
+			dockerfile: "ADD --apt --remove=build-deps",
+			expected:   PackageCommand{PackageNames: []string{}, Remove: "build-deps"},
+		},
+		{
+			dockerfile: "ADD --apt --debconf=debconf.conf tzdata <<EOF\ntzdata tzdata/Areas select Etc\nEOF\n",
+			expected: PackageCommand{
+				PackageNames:    []string{"tzdata"},
+				Debconf:         "debconf.conf",
+				DebconfHeredocs: []string{"tzdata tzdata/Areas select Etc\n"},
+			},
+		},
+	}
+	for _, tc := range cases {
+		ast, err := parser.Parse(strings.NewReader(tc.dockerfile))
+		require.NoError(t, err)
+
+		c, err := ParseInstruction(ast.AST.Children[0])
+		require.NoError(t, err, tc.dockerfile)
+		require.IsType(t, &PackageCommand{}, c)
+
+		cmd := c.(*PackageCommand)
+		cmd.withNameAndCode = withNameAndCode{}
+		require.Equal(t, tc.expected, *cmd, tc.dockerfile)
+	}
+}
+
+func TestPackageCmdExpand(t *testing.T) {
+	ast, err := parser.Parse(strings.NewReader("ADD --apt --mirror=$MIRROR --from=${BASE} --root=/out sl"))
+	require.NoError(t, err)
+	c, err := ParseInstruction(ast.AST.Children[0])
+	require.NoError(t, err)
+
+	cmd := c.(*PackageCommand)
+	var env = map[string]string{"MIRROR": "apt-mirror", "BASE": "debian"}
+	err = cmd.Expand(func(word string) (string, error) {
+		return os.Expand(word, func(name string) string { return env[name] }), nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "apt-mirror", cmd.Mirror)
+	require.Equal(t, "debian", cmd.From)
+	require.Equal(t, "/out", cmd.Root)
+}
+
+func TestParseMounts(t *testing.T) {
+	ast, err := parser.Parse(strings.NewReader("RUN --mount=type=cache,target=$CACHE,sharing=locked true"))
+	require.NoError(t, err)
+	c, err := ParseInstruction(ast.AST.Children[0])
+	require.NoError(t, err)
+	run := c.(*RunCommand)
+
+	mounts, err := ParseMounts(run, func(word string) (string, error) {
+		return strings.ReplaceAll(word, "$CACHE", "/var/cache/apt"), nil
+	})
+	require.NoError(t, err)
+	require.Len(t, mounts, 1)
+	require.Equal(t, MountTypeCache, mounts[0].Type)
+	require.Equal(t, "/var/cache/apt", mounts[0].Target)
+	require.Equal(t, MountSharingLocked, mounts[0].CacheSharing)
+
+	// The command's own mounts are left for dispatch to expand.
+	require.Empty(t, GetMounts(run)[0].Target)
+}
+
 func BenchmarkParseBuildStageName(b *testing.B) {
 	b.ReportAllocs()
 	stageNames := []string{"STAGE_NAME", "StageName", "St4g3N4m3"}
@@ -191,4 +191,76 @@ var (
 		// TODO(crazy-max): deprecate this rule in the future and error out instead
 		// Deprecated: true,
 	}
+	RuleAptGetInstallInRun = LinterRule[func(string) string]{
+		Name:        "AptGetInstallInRun",
+		Description: "Packages installed with RUN apt-get install aren't cached, use ADD --apt instead",
+		URL:         "https://github.com/btidor/syntax#background",
+		Format: func(packages string) string {
+			return fmt.Sprintf("RUN apt-get install can be replaced with 'ADD --apt %s'", packages)
+		},
+	}
+	RuleAptUpdateInSeparateRun = LinterRule[func() string]{
+		Name:        "AptUpdateInSeparateRun",
+		Description: "apt-get update should run in the same RUN instruction as apt-get install, otherwise the install can use stale package lists from the build cache",
+		URL:         "https://docs.docker.com/develop/develop-images/dockerfile_best-practices/#apt-get",
+		Format: func() string {
+			return "apt-get update should be combined with apt-get install in the same RUN instruction"
+		},
+	}
+	RuleAptInScript = LinterRule[func(string) string]{
+		Name:        "AptInScript",
+		Description: "apt does not have a stable command-line interface and is not meant to be used in scripts, use apt-get instead",
+		URL:         "https://manpages.ubuntu.com/manpages/xenial/man8/apt.8.html#script%20usage%20and%20differences%20from%20other%20apt%20tools",
+		Format: func(action string) string {
+			return fmt.Sprintf("Use 'apt-get %s' instead of 'apt %s' in scripts", action, action)
+		},
+	}
+	RuleAptListsNotRemoved = LinterRule[func() string]{
+		Name:        "AptListsNotRemoved",
+		Description: "Package lists left in /var/lib/apt/lists after apt-get install bloat the image layer",
+		URL:         "https://docs.docker.com/develop/develop-images/dockerfile_best-practices/#apt-get",
+		Format: func() string {
+			return "apt-get install without 'rm -rf /var/lib/apt/lists/*' or a cache mount leaves package lists in the image"
+		},
+	}
+	RuleAptDockerCleanShared = LinterRule[func(string) string]{
+		Name:        "AptDockerCleanShared",
+		Description: "Removing docker-clean with a shared apt cache mount lets concurrent builds corrupt the cache, use sharing=locked or ADD --apt instead",
+		URL:         "https://github.com/btidor/syntax#background",
+		Format: func(target string) string {
+			return fmt.Sprintf("docker-clean is removed while %s is a shared cache mount", target)
+		},
+	}
+	RuleAptInstallRewritten = LinterRule[func(string) string]{
+		Name:        "AptInstallRewritten",
+		Description: "RUN apt-get install was rewritten to ADD --apt because BUILDKIT_APT_AUTOREWRITE is set",
+		URL:         "https://github.com/btidor/syntax#details",
+		Format: func(packages string) string {
+			return fmt.Sprintf("RUN apt-get install was rewritten to 'ADD --apt %s'", packages)
+		},
+	}
+	RuleAptPackageWithoutDigest = LinterRule[func(string) string]{
+		Name:        "AptPackageWithoutDigest",
+		Description: "Packages installed with ADD --apt should be verified with a SHA-256 or SHA-512 digest",
+		URL:         "https://github.com/btidor/syntax#details",
+		Format: func(filename string) string {
+			return fmt.Sprintf("Package %s is downloaded without a verifiable digest", filename)
+		},
+	}
+	RuleAptPackageAdvisory = LinterRule[func(string, string) string]{
+		Name:        "AptPackageAdvisory",
+		Description: "Packages installed with ADD --apt should not have known vulnerabilities",
+		URL:         "https://github.com/btidor/syntax#details",
+		Format: func(pkg, advisories string) string {
+			return fmt.Sprintf("Package %s is affected by %s", pkg, advisories)
+		},
+	}
+	RuleAptLinkAfterPackageChanges = LinterRule[func(int) string]{
+		Name:        "AptLinkAfterPackageChanges",
+		Description: "ADD --apt --link should come before other commands that change the installed packages",
+		URL:         "https://github.com/btidor/syntax#details",
+		Format: func(line int) string {
+			return fmt.Sprintf("ADD --apt --link is installed as a regular layer, since line %d may have changed the installed packages", line)
+		},
+	}
 )